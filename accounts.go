@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Tnze/go-mc/bot"
+	GMMAuth "github.com/maxsupermanhd/go-mc-ms-auth"
+)
+
+// authStage is a step of Microsoft to Minecraft authentication chain
+type authStage int
+
+const (
+	authStageMicrosoft authStage = iota
+	authStageXBL
+	authStageXSTS
+	authStageMinecraft
+	authStageProfile
+	// loading or saving credentials
+	authStageStore
+)
+
+func (s authStage) String() string {
+	switch s {
+	case authStageStore:
+		return "Credentials store"
+	case authStageMicrosoft:
+		return "Microsoft"
+	case authStageXBL:
+		return "Xbox Live"
+	case authStageXSTS:
+		return "XSTS"
+	case authStageMinecraft:
+		return "Minecraft"
+	case authStageProfile:
+		return "Minecraft profile"
+	}
+	return "Unknown"
+}
+
+type ErrorAuthStage struct {
+	Account string
+	Stage   authStage
+	Err     error
+}
+
+func (e *ErrorAuthStage) Error() string {
+	return fmt.Sprintf("%s: %s failed: %v", e.Account, e.Stage, e.Err)
+}
+
+func (e *ErrorAuthStage) Unwrap() error {
+	return e.Err
+}
+
+// ErrorRefreshTokenRejected is Microsoft telling that refresh token is no
+// longer valid, unlike other failures it does not fix itself
+type ErrorRefreshTokenRejected struct {
+	Err error
+}
+
+func (e *ErrorRefreshTokenRejected) Error() string {
+	return "refresh token rejected: " + e.Err.Error()
+}
+
+func (e *ErrorRefreshTokenRejected) Unwrap() error {
+	return e.Err
+}
+
+// authProgress is called before every stage is started
+type authProgress func(authStage)
+
+// authBackend talks to Microsoft, Xbox Live and Minecraft services,
+// it is an interface so accountManager can work with fake services
+type authBackend interface {
+	RefreshMicrosoft(auth *GMMAuth.MSauth) error
+	AuthXBL(msToken string) (string, error)
+	AuthXSTS(xblToken string) (GMMAuth.XSTSauth, error)
+	AuthMC(xsts GMMAuth.XSTSauth) (GMMAuth.MCauth, error)
+	Profile(mcToken string) (bot.Auth, error)
+}
+
+// gmmAuthBackend is the real thing
+type gmmAuthBackend struct{}
+
+func (gmmAuthBackend) RefreshMicrosoft(auth *GMMAuth.MSauth) error {
+	// only expired token is refreshed, caller expires it to force refresh
+	auth.ExpiresAfter = 0
+	err := GMMAuth.CheckRefreshMS(auth, getConfig().MicrosoftCID)
+	if err != nil && isRefreshTokenRejected(err) {
+		return &ErrorRefreshTokenRejected{err}
+	}
+	return err
+}
+
+// isRefreshTokenRejected looks for invalid_grant or HTTP 400 in GMMAuth
+// error, it has only the text of Microsoft response
+func isRefreshTokenRejected(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "invalid_grant") || strings.Contains(msg, "got 400 ")
+}
+
+func (gmmAuthBackend) AuthXBL(msToken string) (string, error) {
+	return GMMAuth.AuthXBL(msToken)
+}
+
+func (gmmAuthBackend) AuthXSTS(xblToken string) (GMMAuth.XSTSauth, error) {
+	return GMMAuth.AuthXSTS(xblToken)
+}
+
+func (gmmAuthBackend) AuthMC(xsts GMMAuth.XSTSauth) (GMMAuth.MCauth, error) {
+	return GMMAuth.AuthMC(xsts)
+}
+
+func (gmmAuthBackend) Profile(mcToken string) (bot.Auth, error) {
+	return GMMAuth.GetMCprofile(mcToken)
+}
+
+// accountManager is the only place credentials are refreshed, refreshes
+// of one account are serialized because Microsoft refresh token is
+// rotated on every use and concurrent refreshes would break it
+type accountManager struct {
+	backend   authBackend
+	locks     map[string]*sync.Mutex
+	locksLock sync.Mutex
+}
+
+func newAccountManager(backend authBackend) *accountManager {
+	return &accountManager{backend: backend, locks: map[string]*sync.Mutex{}}
+}
+
+var accounts = newAccountManager(gmmAuthBackend{})
+
+// lock locks account and returns unlock function
+func (m *accountManager) lock(name string) func() {
+	m.locksLock.Lock()
+	l, ok := m.locks[name]
+	if !ok {
+		l = &sync.Mutex{}
+		m.locks[name] = l
+	}
+	m.locksLock.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (m *accountManager) load(name string) (AuthCache, error) {
+	cache, err := loadCredentialsCache(name)
+	if err != nil {
+		return cache, &ErrorAuthStage{name, authStageStore, err}
+	}
+	return cache, nil
+}
+
+func (m *accountManager) store(name string, cache AuthCache) error {
+	err := writeCredentialsCache(name, cache)
+	if err != nil {
+		return &ErrorAuthStage{name, authStageStore, err}
+	}
+	return nil
+}
+
+// chain goes through authentication stages starting with Microsoft
+// refresh or Xbox Live if Microsoft token is fresh
+func (m *accountManager) chain(name string, cache *AuthCache, from authStage, progress authProgress) error {
+	if progress == nil {
+		progress = func(authStage) {}
+	}
+	fail := func(stage authStage, err error) error {
+		return &ErrorAuthStage{name, stage, err}
+	}
+	if from <= authStageMicrosoft {
+		progress(authStageMicrosoft)
+		if err := m.backend.RefreshMicrosoft(&cache.Microsoft); err != nil {
+			return fail(authStageMicrosoft, err)
+		}
+	}
+	progress(authStageXBL)
+	xbl, err := m.backend.AuthXBL(cache.Microsoft.AccessToken)
+	if err != nil {
+		return fail(authStageXBL, err)
+	}
+	progress(authStageXSTS)
+	xsts, err := m.backend.AuthXSTS(xbl)
+	if err != nil {
+		return fail(authStageXSTS, err)
+	}
+	progress(authStageMinecraft)
+	mc, err := m.backend.AuthMC(xsts)
+	if err != nil {
+		return fail(authStageMinecraft, err)
+	}
+	progress(authStageProfile)
+	profile, err := m.backend.Profile(mc.Token)
+	if err != nil {
+		return fail(authStageProfile, err)
+	}
+	cache.Minecraft = mc
+	cache.Username = profile.Name
+	cache.UUID = profile.UUID
+	return nil
+}
+
+// Auth returns Minecraft credentials of the account, refreshing them if
+// Minecraft token is expired
+func (m *accountManager) Auth(name string, progress authProgress) (bot.Auth, error) {
+	defer m.lock(name)()
+	cache, err := m.load(name)
+	if err != nil {
+		return bot.Auth{}, err
+	}
+	if isDateExpired(cache.Minecraft.ExpiresAfter) {
+		from := authStageMicrosoft
+		if !isDateExpired(cache.Microsoft.ExpiresAfter) {
+			from = authStageXBL
+		}
+		if err := m.chain(name, &cache, from, progress); err != nil {
+			return bot.Auth{}, err
+		}
+		if err := m.store(name, cache); err != nil {
+			return bot.Auth{}, err
+		}
+	}
+	return bot.Auth{Name: cache.Username, UUID: cache.UUID, AsTk: cache.Minecraft.Token}, nil
+}
+
+// Refresh renews every token of the account
+func (m *accountManager) Refresh(name string, progress authProgress) (AuthCache, error) {
+	defer m.lock(name)()
+	cache, err := m.load(name)
+	if err != nil {
+		return cache, err
+	}
+	if err := m.chain(name, &cache, authStageMicrosoft, progress); err != nil {
+		return cache, err
+	}
+	return cache, m.store(name, cache)
+}
+
+// RefreshExpiring renews every token of the account if Minecraft token
+// expires in less than ahead, tells if refresh was done
+func (m *accountManager) RefreshExpiring(name string, ahead time.Duration) (bool, error) {
+	defer m.lock(name)()
+	cache, err := m.load(name)
+	if err != nil {
+		return false, err
+	}
+	if time.Until(time.Unix(cache.Minecraft.ExpiresAfter, 0)) > ahead {
+		return false, nil
+	}
+	if err := m.chain(name, &cache, authStageMicrosoft, nil); err != nil {
+		return true, err
+	}
+	return true, m.store(name, cache)
+}
+
+// Login finishes authentication of account that just got Microsoft
+// token from device flow and stores it
+func (m *accountManager) Login(name string, ms GMMAuth.MSauth, progress authProgress) (AuthCache, error) {
+	cache := AuthCache{Microsoft: ms}
+	if err := m.chain(name, &cache, authStageXBL, progress); err != nil {
+		return cache, err
+	}
+	defer m.lock(name)()
+	return cache, m.store(name, cache)
+}
+
+// authStatus shows progress of authentication stages in a status message
+type authStatus struct {
+	status *statusMessage
+	title  string
+	first  authStage
+	stage  authStage
+	active bool
+}
+
+func newAuthStatus(status *statusMessage, title string) *authStatus {
+	return &authStatus{status: status, title: title}
+}
+
+func (a *authStatus) render(last string) string {
+	ret := a.title
+	for s := a.first; s < a.stage; s++ {
+		ret += "\n`" + s.String() + "` :white_check_mark:"
+	}
+	return ret + "\n`" + a.stage.String() + "` " + last
+}
+
+// Progress can be passed to accountManager methods
+func (a *authStatus) Progress(stage authStage) {
+	if !a.active {
+		a.first = stage
+		a.active = true
+	}
+	a.stage = stage
+	a.status.Update(a.render(":arrows_counterclockwise:"))
+}
+
+// Fail shows error, stage it failed on is marked if it is known
+func (a *authStatus) Fail(err error) {
+	var stageErr *ErrorAuthStage
+	if errors.As(err, &stageErr) {
+		if !a.active {
+			a.first = stageErr.Stage
+		}
+		a.stage = stageErr.Stage
+		a.status.Update(a.render(":interrobang: " + stageErr.Err.Error()))
+		return
+	}
+	a.status.Update(a.title + "\n:interrobang: " + err.Error())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tnze/go-mc/bot"
+	GMMAuth "github.com/maxsupermanhd/go-mc-ms-auth"
+)
+
+// fakeAuthBackend rotates Microsoft refresh token like the real one does
+// and records stages it went through
+type fakeAuthBackend struct {
+	fail  authStage
+	err   error
+	delay time.Duration
+
+	lock      sync.Mutex
+	stages    []authStage
+	active    int
+	maxActive int
+}
+
+func (f *fakeAuthBackend) enter(stage authStage) error {
+	f.lock.Lock()
+	f.stages = append(f.stages, stage)
+	f.active++
+	if f.active > f.maxActive {
+		f.maxActive = f.active
+	}
+	f.lock.Unlock()
+	time.Sleep(f.delay)
+	f.lock.Lock()
+	f.active--
+	f.lock.Unlock()
+	if f.err != nil && f.fail == stage {
+		return f.err
+	}
+	return nil
+}
+
+func (f *fakeAuthBackend) RefreshMicrosoft(auth *GMMAuth.MSauth) error {
+	if err := f.enter(authStageMicrosoft); err != nil {
+		return err
+	}
+	auth.AccessToken = "ms"
+	auth.RefreshToken += "+"
+	auth.ExpiresAfter = time.Now().Add(time.Hour).Unix()
+	return nil
+}
+
+func (f *fakeAuthBackend) AuthXBL(msToken string) (string, error) {
+	return "xbl", f.enter(authStageXBL)
+}
+
+func (f *fakeAuthBackend) AuthXSTS(xblToken string) (GMMAuth.XSTSauth, error) {
+	return GMMAuth.XSTSauth{Token: "xsts"}, f.enter(authStageXSTS)
+}
+
+func (f *fakeAuthBackend) AuthMC(xsts GMMAuth.XSTSauth) (GMMAuth.MCauth, error) {
+	return GMMAuth.MCauth{Token: "mc", ExpiresAfter: time.Now().Add(time.Hour).Unix()}, f.enter(authStageMinecraft)
+}
+
+func (f *fakeAuthBackend) Profile(mcToken string) (bot.Auth, error) {
+	return bot.Auth{Name: "player", UUID: "uuid"}, f.enter(authStageProfile)
+}
+
+// setupFakeAccount opens memory store with one account in it
+func setupFakeAccount(t *testing.T, cache AuthCache) {
+	t.Helper()
+	conf := &BotConfiguration{CredentialsStore: credentialsStoreMemory}
+	if err := setupCredentialsStore(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeCredentialsStore)
+	setConfig(conf)
+	if err := writeCredentialsCache("acc", cache); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccountManagerStageErrors(t *testing.T) {
+	stages := []authStage{authStageMicrosoft, authStageXBL, authStageXSTS, authStageMinecraft, authStageProfile}
+	for _, stage := range stages {
+		setupFakeAccount(t, AuthCache{Microsoft: GMMAuth.MSauth{RefreshToken: "token"}})
+		backend := &fakeAuthBackend{fail: stage, err: errors.New("service is down")}
+		_, err := newAccountManager(backend).Refresh("acc", nil)
+		var stageErr *ErrorAuthStage
+		if !errors.As(err, &stageErr) {
+			t.Errorf("%s: got %v, want ErrorAuthStage", stage, err)
+			continue
+		}
+		if stageErr.Stage != stage || stageErr.Account != "acc" || stageErr.Err != backend.err {
+			t.Errorf("%s: got %s of %s: %v", stage, stageErr.Stage, stageErr.Account, stageErr.Err)
+		}
+	}
+
+	closeCredentialsStore()
+	_, err := newAccountManager(&fakeAuthBackend{}).Refresh("acc", nil)
+	var stageErr *ErrorAuthStage
+	if !errors.As(err, &stageErr) || stageErr.Stage != authStageStore {
+		t.Errorf("closed store: got %v, want store stage error", err)
+	}
+}
+
+func TestAccountManagerAuthStart(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		microsoft int64
+		minecraft int64
+		want      []authStage
+	}{
+		{"fresh", now.Add(time.Hour).Unix(), now.Add(time.Hour).Unix(), nil},
+		{"minecraft expired", now.Add(time.Hour).Unix(), now.Add(-time.Hour).Unix(),
+			[]authStage{authStageXBL, authStageXSTS, authStageMinecraft, authStageProfile}},
+		{"both expired", now.Add(-time.Hour).Unix(), now.Add(-time.Hour).Unix(),
+			[]authStage{authStageMicrosoft, authStageXBL, authStageXSTS, authStageMinecraft, authStageProfile}},
+	}
+	for _, tt := range tests {
+		setupFakeAccount(t, AuthCache{
+			Microsoft: GMMAuth.MSauth{AccessToken: "ms", RefreshToken: "token", ExpiresAfter: tt.microsoft},
+			Minecraft: GMMAuth.MCauth{Token: "old", ExpiresAfter: tt.minecraft},
+		})
+		backend := &fakeAuthBackend{}
+		progress := []authStage{}
+		auth, err := newAccountManager(backend).Auth("acc", func(s authStage) { progress = append(progress, s) })
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(backend.stages) != len(tt.want) || len(progress) != len(tt.want) {
+			t.Errorf("%s: went through %v (progress %v), want %v", tt.name, backend.stages, progress, tt.want)
+			continue
+		}
+		for i := range tt.want {
+			if backend.stages[i] != tt.want[i] || progress[i] != tt.want[i] {
+				t.Errorf("%s: went through %v (progress %v), want %v", tt.name, backend.stages, progress, tt.want)
+				break
+			}
+		}
+		wantToken := "mc"
+		if tt.want == nil {
+			wantToken = "old"
+		}
+		if auth.AsTk != wantToken {
+			t.Errorf("%s: got token %s, want %s", tt.name, auth.AsTk, wantToken)
+		}
+	}
+}
+
+func TestAccountManagerConcurrentRefresh(t *testing.T) {
+	setupFakeAccount(t, AuthCache{Microsoft: GMMAuth.MSauth{RefreshToken: "token"}})
+	backend := &fakeAuthBackend{delay: 10 * time.Millisecond}
+	m := newAccountManager(backend)
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = m.Refresh("acc", nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if backend.maxActive != 1 {
+		t.Errorf("%d refreshes ran at once", backend.maxActive)
+	}
+	cache, err := getCredentialsCache("acc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// second refresh has to use token rotated by the first one
+	if cache.Microsoft.RefreshToken != "token++" {
+		t.Errorf("got refresh token %s, want token++", cache.Microsoft.RefreshToken)
+	}
+}
+
+func TestIsRefreshTokenRejected(t *testing.T) {
+	tests := []struct {
+		err  string
+		want bool
+	}{
+		{`MS refresh attempt answered not HTTP200! Instead got 400 Bad Request and following json: map[string]interface {}{"error":"invalid_grant"}`, true},
+		{`MS refresh attempt answered not HTTP200! Instead got 400 Bad Request and following json: map[string]interface {}{}`, true},
+		{`MS refresh attempt answered not HTTP200! Instead got 503 Service Unavailable and following json: map[string]interface {}{}`, false},
+		{`Post "https://login.live.com/oauth20_token.srf": dial tcp: i/o timeout`, false},
+		{`Access_token not found in response`, false},
+	}
+	for _, tt := range tests {
+		if got := isRefreshTokenRejected(errors.New(tt.err)); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
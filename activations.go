@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// activationTicket is a place in the activation queue of an account
+type activationTicket struct {
+	queue   *activationQueue
+	account string
+	// chamber is Chamber.Index or -1 for every chamber, position in the
+	// room changes when chambers are removed
+	chamber int
+	ready   chan struct{}
+	// moves gets how many activations are ahead when queue moves, only
+	// the latest count is kept, owner reads it while waiting for ready
+	moves chan int
+	// merged are told result of the activation that was requested again
+	merged []func(activationResult)
+}
+
+// activationQueue lets only one login per account happen at a time,
+// a second login with the same account would kick the first one.
+// Different accounts do not wait for each other.
+type activationQueue struct {
+	lock    sync.Mutex
+	tickets map[string][]*activationTicket
+}
+
+var activations = &activationQueue{tickets: map[string][]*activationTicket{}}
+
+// enter queues activation of chamber, if the same chamber is already
+// waiting or being activated ticket of that activation is returned
+// instead with merged set and onMerged gets its result. Ticket is ready
+// once everything ahead is done.
+func (q *activationQueue) enter(account string, chamber int, onMerged func(activationResult)) (t *activationTicket, ahead int, merged bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, t := range q.tickets[account] {
+		if t.chamber == chamber {
+			t.merged = append(t.merged, onMerged)
+			return t, 0, true
+		}
+	}
+	t = &activationTicket{queue: q, account: account, chamber: chamber, ready: make(chan struct{}), moves: make(chan int, 1)}
+	ahead = len(q.tickets[account])
+	q.tickets[account] = append(q.tickets[account], t)
+	if ahead == 0 {
+		close(t.ready)
+	}
+	return t, ahead, false
+}
+
+// leave removes ticket from the queue, next activation gets its turn and
+// requests merged into this one get result r
+func (t *activationTicket) leave(r activationResult) {
+	q := t.queue
+	q.lock.Lock()
+	tickets := q.tickets[t.account]
+	for i, tt := range tickets {
+		if tt != t {
+			continue
+		}
+		tickets = append(tickets[:i:i], tickets[i+1:]...)
+		if i == 0 && len(tickets) > 0 {
+			close(tickets[0].ready)
+			// count that was not read yet is stale now
+			select {
+			case <-tickets[0].moves:
+			default:
+			}
+		}
+		// first one knows it is its turn, it does not need to be told
+		for ahead, tt := range tickets {
+			if ahead > 0 {
+				tt.move(ahead)
+			}
+		}
+		break
+	}
+	if len(tickets) == 0 {
+		delete(q.tickets, t.account)
+	} else {
+		q.tickets[t.account] = tickets
+	}
+	// nothing gets merged into ticket that is out of the queue
+	merged := t.merged
+	q.lock.Unlock()
+	for _, f := range merged {
+		f(r)
+	}
+}
+
+// move replaces count that owner did not read yet, called with queue
+// locked so counts can not arrive out of order
+func (t *activationTicket) move(ahead int) {
+	select {
+	case <-t.moves:
+	default:
+	}
+	t.moves <- ahead
+}
+
+func queuedBehindString(ahead int) string {
+	if ahead == 1 {
+		return "Queued behind 1 activation of this account..."
+	}
+	return fmt.Sprintf("Queued behind %d activations of this account...", ahead)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestActivationQueueMoves(t *testing.T) {
+	q := &activationQueue{tickets: map[string][]*activationTicket{}}
+	first, ahead, _ := q.enter("acc", 1, nil)
+	if ahead != 0 {
+		t.Fatalf("first ticket has %d ahead", ahead)
+	}
+	second, _, _ := q.enter("acc", 2, nil)
+	third, ahead, _ := q.enter("acc", 3, nil)
+	if ahead != 2 {
+		t.Fatalf("third ticket has %d ahead, want 2", ahead)
+	}
+	other, ahead, _ := q.enter("other", 1, nil)
+	if ahead != 0 {
+		t.Errorf("ticket of other account waits for %d", ahead)
+	}
+	other.leave(activationResult{})
+
+	first.leave(activationResult{})
+	select {
+	case <-second.ready:
+	default:
+		t.Fatal("second ticket is not ready after first left")
+	}
+	// count that was not read is dropped once ticket is ready
+	second.leave(activationResult{})
+	select {
+	case ahead := <-third.moves:
+		t.Fatalf("third ticket got move to %d after it got ready", ahead)
+	default:
+	}
+	select {
+	case <-third.ready:
+	default:
+		t.Fatal("third ticket is not ready")
+	}
+	third.leave(activationResult{})
+	if len(q.tickets) != 0 {
+		t.Errorf("queue is not empty: %v", q.tickets)
+	}
+}
+
+func TestActivationQueueMovesLatest(t *testing.T) {
+	q := &activationQueue{tickets: map[string][]*activationTicket{}}
+	tickets := []*activationTicket{}
+	for chamber := 0; chamber < 5; chamber++ {
+		tt, _, _ := q.enter("acc", chamber, nil)
+		tickets = append(tickets, tt)
+	}
+	tickets[3].leave(activationResult{})
+	tickets[2].leave(activationResult{})
+	// owner that was busy sees only the latest count
+	if ahead := <-tickets[4].moves; ahead != 2 {
+		t.Errorf("got %d ahead, want 2", ahead)
+	}
+	select {
+	case ahead := <-tickets[4].moves:
+		t.Errorf("got stale move to %d ahead", ahead)
+	default:
+	}
+	for _, tt := range []*activationTicket{tickets[0], tickets[1], tickets[4]} {
+		tt.leave(activationResult{})
+	}
+}
+
+func TestActivationQueueMerged(t *testing.T) {
+	q := &activationQueue{tickets: map[string][]*activationTicket{}}
+	owner, _, _ := q.enter("acc", 1, nil)
+	results := []activationResult{}
+	for i := 0; i < 2; i++ {
+		tt, ahead, merged := q.enter("acc", 1, func(r activationResult) {
+			results = append(results, r)
+		})
+		if !merged || tt != owner || ahead != 0 {
+			t.Fatalf("request of the same chamber was not merged: %v %d %v", merged, ahead, tt == owner)
+		}
+	}
+	r := activationResult{activationActivated, "pearl is gone"}
+	owner.leave(r)
+	if len(results) != 2 || results[0] != r || results[1] != r {
+		t.Fatalf("merged requests got %v, want %v twice", results, r)
+	}
+	// once ticket left the queue the same chamber is a new activation
+	if _, _, merged := q.enter("acc", 1, nil); merged {
+		t.Error("request was merged into ticket that left the queue")
+	}
+}
+
+func TestActivationQueueConcurrent(t *testing.T) {
+	q := &activationQueue{tickets: map[string][]*activationTicket{}}
+	var wg sync.WaitGroup
+	var active, maxActive int32
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(chamber int) {
+			defer wg.Done()
+			ticket, _, merged := q.enter("acc", chamber, func(activationResult) {})
+			if merged {
+				return
+			}
+			for waiting := true; waiting; {
+				select {
+				case <-ticket.ready:
+					waiting = false
+				case <-ticket.moves:
+				}
+			}
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&maxActive)
+				if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			ticket.leave(activationResult{activationActivated, ""})
+		}(i % 4)
+	}
+	wg.Wait()
+	if maxActive != 1 {
+		t.Errorf("%d activations of one account ran at once", maxActive)
+	}
+	if len(q.tickets) != 0 {
+		t.Errorf("queue is not empty: %v", q.tickets)
+	}
+}
+
+func TestActivationMergeKey(t *testing.T) {
+	room := PearlRoom{Chambers: []Chamber{{Index: 1}, {Index: 2}, {Index: 3}}}
+	q := &activationQueue{tickets: map[string][]*activationTicket{}}
+	q.enter("acc", room.chamberIndex(1), nil)
+	// chamber 2 is removed, chamber 3 takes its place in the room
+	room.Chambers = append(room.Chambers[:1], room.Chambers[2:]...)
+	if _, _, merged := q.enter("acc", room.chamberIndex(1), func(activationResult) {}); merged {
+		t.Error("chamber 3 was merged into activation of removed chamber 2")
+	}
+	if _, _, merged := q.enter("acc", room.chamberIndex(-1), func(activationResult) {}); merged {
+		t.Error("activation of every chamber was merged into single chamber")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	defaultAuditLogPath = "./audit.log"
+	defaultAuditLimit   = 20
+)
+
+// auditEntry is a single line of append-only audit log
+type auditEntry struct {
+	Time     time.Time     `json:"time"`
+	Action   string        `json:"action"`
+	User     string        `json:"user,omitempty"`
+	Room     string        `json:"room,omitempty"`
+	Chamber  string        `json:"chamber,omitempty"`
+	Result   string        `json:"result,omitempty"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// String is a one line summary of the entry for Discord
+func (e auditEntry) String() string {
+	ret := "`" + e.Time.Format("2006-01-02 15:04:05") + "` " + e.Action
+	if e.User != "" {
+		ret += " by <@" + e.User + ">"
+	}
+	if e.Room != "" {
+		ret += " room `" + e.Room + "`"
+	}
+	if e.Chamber != "" {
+		ret += " chamber " + e.Chamber
+	}
+	if e.Result != "" {
+		ret += ": " + e.Result
+	}
+	if e.Duration != 0 {
+		ret += " in " + e.Duration.Round(time.Millisecond).String()
+	}
+	if e.Detail != "" {
+		ret += " (" + e.Detail + ")"
+	}
+	return ret
+}
+
+var auditLock sync.Mutex
+
+func auditLogPath() string {
+	conf := getConfig()
+	if conf == nil || conf.AuditLogPath == "" {
+		return defaultAuditLogPath
+	}
+	return conf.AuditLogPath
+}
+
+// writeAudit appends entry to the audit log and posts it to the service
+// channel, failures are only logged because there is nobody to report them to
+func writeAudit(s *discordgo.Session, e auditEntry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to marshal audit entry: %v", err)
+		return
+	}
+	auditLock.Lock()
+	f, err := os.OpenFile(auditLogPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Failed to open audit log: %v", err)
+	} else {
+		_, err = f.Write(append(line, '\n'))
+		if err != nil {
+			log.Printf("Failed to write audit log: %v", err)
+		}
+		f.Close()
+	}
+	auditLock.Unlock()
+	// callers often did not respond to interaction yet, rate limited post
+	// must not make them miss interaction deadline
+	if conf := getConfig(); s != nil && conf != nil && conf.DiscordServiceChannel != "" {
+		go postAudit(s, conf.DiscordServiceChannel, e.String())
+	}
+}
+
+func postAudit(s *discordgo.Session, channelID, content string) {
+	_, err := s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		log.Printf("Failed to post audit entry: %v", err)
+	}
+}
+
+// auditFilter selects entries of the audit log, empty fields match everything
+type auditFilter struct {
+	Room  string
+	User  string
+	Since time.Time
+	Until time.Time
+}
+
+func (f auditFilter) match(e auditEntry) bool {
+	return (f.Room == "" || f.Room == e.Room) &&
+		(f.User == "" || f.User == e.User) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || !e.Time.After(f.Until))
+}
+
+// readAudit returns up to limit latest entries matching filter, newest first
+func readAudit(filter auditFilter, limit int) ([]auditEntry, error) {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	f, err := os.Open(auditLogPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	found := []auditEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if filter.match(e) {
+			found = append(found, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	ret := []auditEntry{}
+	for i := len(found) - 1; i >= 0 && len(ret) < limit; i-- {
+		ret = append(ret, found[i])
+	}
+	return ret, nil
+}
+
+// parseAuditTime accepts duration back from now (24h), date or RFC3339 time
+func parseAuditTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("`%s` is not a duration (24h), date (2006-01-02) or RFC3339 time", s)
+}
+
+func commandAudit(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	opts := optionsMap(i.ApplicationCommandData().Options)
+	filter := auditFilter{Room: optionString(opts, "room")}
+	if u, ok := opts["user"]; ok {
+		filter.User = u.UserValue(nil).ID
+	}
+	var err error
+	if v := optionString(opts, "since"); v != "" {
+		if filter.Since, err = parseAuditTime(v); err != nil {
+			iEphemeralResponse(s, i, err.Error())
+			return
+		}
+	}
+	if v := optionString(opts, "until"); v != "" {
+		if filter.Until, err = parseAuditTime(v); err != nil {
+			iEphemeralResponse(s, i, err.Error())
+			return
+		}
+	}
+	limit := defaultAuditLimit
+	if l, ok := opts["limit"]; ok && l.IntValue() > 0 {
+		limit = int(l.IntValue())
+	}
+	entries, err := readAudit(filter, limit)
+	if err != nil {
+		iEphemeralResponse(s, i, "Failed to read audit log: "+err.Error())
+		return
+	}
+	if len(entries) == 0 {
+		iEphemeralResponse(s, i, "No audit entries found")
+		return
+	}
+	resp := ""
+	for _, e := range entries {
+		line := e.String() + "\n"
+		if len(resp)+len(line) > 2000 {
+			break
+		}
+		resp += line
+	}
+	iQuietTextResponse(s, i, strings.TrimSuffix(resp, "\n"))
+}
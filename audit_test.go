@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteAuditDoesNotWaitForDiscord(t *testing.T) {
+	prev := getConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	path := filepath.Join(t.TempDir(), "audit.log")
+	setConfig(&BotConfiguration{AuditLogPath: path, DiscordServiceChannel: "123456789012345678"})
+	f := &fakeDiscord{release: make(chan struct{})}
+	s := fakeDiscordSession(t, f)
+
+	done := make(chan struct{})
+	go func() {
+		writeAudit(s, auditEntry{Action: "denied", User: "1", Detail: "/config requires admin-config"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("audit waited for service channel post")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"action":"denied"`) {
+		t.Errorf("audit log has no entry: %s", data)
+	}
+	close(f.release)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(f.Requests()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("audit entry was not posted to service channel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if r := f.Requests()[0]; r.path != "/api/v8/channels/123456789012345678/messages" {
+		t.Errorf("posted to %s", r.path)
+	}
+}
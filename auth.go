@@ -3,11 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
@@ -41,64 +39,74 @@ func isDateExpired(d int64) bool {
 	return d+2 <= time.Now().Unix()
 }
 
-func getCredentialsCache(path string) (out AuthCache, err error) {
-	path = config.AccountsCredentialCachePath + path
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return out, err
-	} else {
-		cachefile, err := os.Open(path)
-		if err != nil {
-			return out, err
-		}
-		defer cachefile.Close()
-		cachecontent, err := ioutil.ReadAll(cachefile)
-		if err != nil {
-			return out, err
-		}
-		err = json.Unmarshal(cachecontent, &out)
-		if err != nil {
-			return out, err
-		}
+// readCredentialsCache reads cache, migrate tells that it is plaintext or
+// encrypted with previous key and has to be written again
+func readCredentialsCache(name string) (out AuthCache, migrate bool, err error) {
+	var data []byte
+	err = useCredentialsStore(func(store credentialsStore) (err error) {
+		data, err = store.Load(name)
+		return err
+	})
+	if err != nil {
+		return out, false, err
+	}
+	plain, migrate, err := openCache(data)
+	if err != nil {
+		return out, false, err
+	}
+	err = json.Unmarshal(plain, &out)
+	return out, migrate, err
+}
+
+// getCredentialsCache reads cache without writing anything, it does not
+// need account lock
+func getCredentialsCache(name string) (AuthCache, error) {
+	out, _, err := readCredentialsCache(name)
+	return out, err
+}
+
+// loadCredentialsCache reads cache and writes it again with the current
+// key if needed. Caller holds accounts.lock(name), otherwise old tokens
+// could be written over ones refresh just got.
+func loadCredentialsCache(name string) (AuthCache, error) {
+	out, migrate, err := readCredentialsCache(name)
+	if err != nil || !migrate {
 		return out, err
 	}
+	err = writeCredentialsCache(name, out)
+	if err != nil {
+		return out, fmt.Errorf("failed to encrypt credentials cache: %w", err)
+	}
+	log.Printf("Credentials cache %s encrypted with current key", name)
+	return out, nil
 }
 
-func writeCredentialsCache(path string, cache AuthCache) error {
-	path = config.AccountsCredentialCachePath + path
+func writeCredentialsCache(name string, cache AuthCache) error {
 	cacheb, err := json.MarshalIndent(cache, "", "\t")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, cacheb, 0600)
+	cacheb, err = sealCache(cacheb)
+	if err != nil {
+		return err
+	}
+	return useCredentialsStore(func(store credentialsStore) error {
+		return store.Save(name, cacheb)
+	})
 }
 
-func checkCredentialsValid(path string) (string, error) {
-	path = config.AccountsCredentialCachePath + path
-	if _, err := os.Stat(path); os.IsNotExist(err) {
+func checkCredentialsValid(name string) (string, error) {
+	cache, err := getCredentialsCache(name)
+	if err != nil {
 		return "", err
-	} else {
-		cachefile, err := os.Open(path)
-		if err != nil {
-			return "", err
-		}
-		defer cachefile.Close()
-		cachecontent, err := ioutil.ReadAll(cachefile)
-		if err != nil {
-			return "", err
-		}
-		var cache AuthCache
-		err = json.Unmarshal(cachecontent, &cache)
-		if err != nil {
-			return "", err
-		}
-		if isDateExpired(cache.Microsoft.ExpiresAfter) {
-			return cache.Username, &ErrorMicrosoftCacheExpired{time.Unix(cache.Microsoft.ExpiresAfter, 0)}
-		}
-		if isDateExpired(cache.Minecraft.ExpiresAfter) {
-			return cache.Username, &ErrorMinecraftCacheExpired{time.Unix(cache.Minecraft.ExpiresAfter, 0)}
-		}
-		return cache.Username, nil
 	}
+	if isDateExpired(cache.Microsoft.ExpiresAfter) {
+		return cache.Username, &ErrorMicrosoftCacheExpired{time.Unix(cache.Microsoft.ExpiresAfter, 0)}
+	}
+	if isDateExpired(cache.Minecraft.ExpiresAfter) {
+		return cache.Username, &ErrorMinecraftCacheExpired{time.Unix(cache.Minecraft.ExpiresAfter, 0)}
+	}
+	return cache.Username, nil
 }
 
 func commandAuthCheck(s *discordgo.Session, i *discordgo.InteractionCreate) {
@@ -168,83 +176,29 @@ func commandAuthRefresh(s *discordgo.Session, i *discordgo.InteractionCreate) {
 			return
 		}
 	}
-	cache, err := getCredentialsCache(room.AccountCredentialsName)
+	started := time.Now()
+	result := "failed"
+	defer func() {
+		writeAudit(s, auditEntry{
+			Action:   "auth refresh",
+			User:     interactionUserID(i),
+			Room:     room.RoomName,
+			Result:   result,
+			Duration: time.Since(started),
+		})
+	}()
+	progress := newAuthStatus(interactionStatus(s, i), "Refreshing credentials of room `"+room.RoomName+"`")
+	cache, err := accounts.Refresh(room.AccountCredentialsName, progress.Progress)
 	if err != nil {
-		iTextResponse(s, i, "Failed to load credential cache: "+err.Error())
+		progress.Fail(err)
 		return
 	}
-	resp := []string{"Account " + usernameBeautify(cache.Username), "", ""}
-	responseSent := false
-	if isDateExpired(cache.Microsoft.ExpiresAfter) {
-		resp[1] = "`Microsoft` :arrows_counterclockwise: Refreshing..."
-		iTextResponse(s, i, sliceConcat(resp))
-		responseSent = true
-		err := GMMAuth.CheckRefreshMS(&cache.Microsoft, config.MicrosoftCID)
-		if err != nil {
-			resp[1] = "`Microsoft` :interrobang: Refresh failed: " + err.Error()
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-			return
-		}
-		err = writeCredentialsCache(room.AccountCredentialsName, cache)
-		if err != nil {
-			resp[1] = "`Microsoft` :interrobang: Failed to save refreshed token: " + err.Error()
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-			return
-		}
-		resp[1] = "`Microsoft` :white_check_mark: Refreshed, will be active for " + tokenValidForString(cache.Microsoft.ExpiresAfter)
-	} else {
-		resp[1] = "`Microsoft` :white_check_mark: will be active for " + tokenValidForString(cache.Microsoft.ExpiresAfter)
-	}
-	if isDateExpired(cache.Minecraft.ExpiresAfter) {
-		resp[2] = "`Minecraft` :arrows_counterclockwise: Refreshing..."
-		if responseSent {
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-		} else {
-			iTextResponse(s, i, sliceConcat(resp))
-		}
-		XBLa, err := GMMAuth.AuthXBL(cache.Microsoft.AccessToken)
-		if err != nil {
-			resp[2] = "`Minecraft` :interrobang: Refresh failed (XBL): " + err.Error()
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-			return
-		}
-		XSTSa, err := GMMAuth.AuthXSTS(XBLa)
-		if err != nil {
-			resp[2] = "`Minecraft` :interrobang: Refresh failed (XSTS): " + err.Error()
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-			return
-		}
-		MCa, err := GMMAuth.AuthMC(XSTSa)
-		if err != nil {
-			resp[2] = "`Minecraft` :interrobang: Refresh failed (MC): " + err.Error()
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-			return
-		}
-		resauth, err := GMMAuth.GetMCprofile(MCa.Token)
-		if err != nil {
-			resp[2] = "`Minecraft` :interrobang: Refresh failed (Profile): " + err.Error()
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-			return
-		}
-		cache.Minecraft = MCa
-		cache.UUID = resauth.UUID
-		cache.Username = resauth.Name
-		err = writeCredentialsCache(room.AccountCredentialsName, cache)
-		if err != nil {
-			resp[2] = "`Minecraft` :interrobang: Refreshed, failed to write to cache: " + err.Error()
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-			return
-		}
-		resp[2] = "`Minecraft` :white_check_mark: Refreshed, will be active for " + tokenValidForString(cache.Minecraft.ExpiresAfter)
-		s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-	} else {
-		resp[2] = "`Minecraft` :white_check_mark: will be active for " + tokenValidForString(cache.Minecraft.ExpiresAfter)
-		if responseSent {
-			s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{Content: sliceConcat(resp)})
-		} else {
-			iTextResponse(s, i, sliceConcat(resp))
-		}
-	}
+	result = "ok"
+	progress.status.Update(sliceConcat([]string{
+		"Account " + usernameBeautify(cache.Username),
+		"`Microsoft` :white_check_mark: Refreshed, will be active for " + tokenValidForString(cache.Microsoft.ExpiresAfter),
+		"`Minecraft` :white_check_mark: Refreshed, will be active for " + tokenValidForString(cache.Minecraft.ExpiresAfter),
+	}))
 }
 
 func commandAuthNew(s *discordgo.Session, i *discordgo.InteractionCreate) {
@@ -274,9 +228,22 @@ func commandAuthNew(s *discordgo.Session, i *discordgo.InteractionCreate) {
 			return
 		}
 	}
+	started := time.Now()
+	result := "failed"
+	detail := ""
+	defer func() {
+		writeAudit(s, auditEntry{
+			Action:   "auth new",
+			User:     interactionUserID(i),
+			Room:     room.RoomName,
+			Result:   result,
+			Detail:   detail,
+			Duration: time.Since(started),
+		})
+	}()
 	var auth GMMAuth.MSauth
 	DeviceResp, err := http.PostForm("https://login.microsoftonline.com/consumers/oauth2/v2.0/devicecode", url.Values{
-		"client_id": {config.MicrosoftCID},
+		"client_id": {getConfig().MicrosoftCID},
 		"scope":     {`XboxLive.signin offline_access`},
 	})
 	if err != nil {
@@ -332,7 +299,7 @@ func commandAuthNew(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	for {
 		time.Sleep(time.Duration(int(PoolInterval)+1) * time.Second)
 		CodeResp, err := http.PostForm("https://login.microsoftonline.com/consumers/oauth2/v2.0/token", url.Values{
-			"client_id":   {config.MicrosoftCID},
+			"client_id":   {getConfig().MicrosoftCID},
 			"scope":       {"XboxLive.signin offline_access"},
 			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
 			"device_code": {DeviceCode},
@@ -398,51 +365,30 @@ func commandAuthNew(s *discordgo.Session, i *discordgo.InteractionCreate) {
 		iTextResponse(s, i, "bug in msa loop")
 		return
 	}
-	iTextResponse(s, i, "Microsoft authentication completed, getting Minecraft credentials...")
-	XBLa, err := GMMAuth.AuthXBL(auth.AccessToken)
+	progress := newAuthStatus(channelStatus(s, i.ChannelID), "Microsoft authentication completed, getting Minecraft credentials...")
+	cache, err := accounts.Login(room.AccountCredentialsName, auth, progress.Progress)
 	if err != nil {
-		iTextResponse(s, i, "Failed to get XBL token: "+err.Error())
+		progress.Fail(err)
 		return
 	}
-	XSTSa, err := GMMAuth.AuthXSTS(XBLa)
-	if err != nil {
-		iTextResponse(s, i, "Failed to get XSTS token: "+err.Error())
-		return
-	}
-	MCa, err := GMMAuth.AuthMC(XSTSa)
-	if err != nil {
-		iTextResponse(s, i, "Failed to get Minecraft token: "+err.Error())
-		return
-	}
-	MCs, err := GMMAuth.GetMCprofile(MCa.Token)
-	if err != nil {
-		iTextResponse(s, i, "Failed to get Minecraft profile: "+err.Error())
-		return
-	}
-	cache := AuthCache{
-		Microsoft: auth,
-		Minecraft: MCa,
-		Username:  MCs.Name,
-		UUID:      MCs.UUID,
-	}
-	iTextResponse(s, i, "Successfully authenticated with account `"+cache.Username+"` (UUID `"+cache.UUID+"`)")
-	err = writeCredentialsCache(room.AccountCredentialsName, cache)
-	if err != nil {
-		iTextResponse(s, i, "Failed to store authentication! "+err.Error())
-	}
+	detail = "account " + cache.Username
+	result = "ok"
+	progress.status.Update("Successfully authenticated with account `" + cache.Username + "` (UUID `" + cache.UUID + "`)")
 }
 
 func commandAuth(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	// spew.Dump(i.ApplicationCommandData().Options)
 	cmd := i.ApplicationCommandData().Options[0].Name
-	if cmd == "check" {
+	switch cmd {
+	case "check":
 		commandAuthCheck(s, i)
-	}
-	if cmd == "refresh" {
+	case "refresh":
 		commandAuthRefresh(s, i)
-	}
-	if cmd == "new" {
+	case "new":
 		commandAuthNew(s, i)
+	case "rotate-key":
+		commandAuthRotateKey(s, i)
+	default:
+		iTextResponse(s, i, "Allowed subcommands: check, refresh, new, rotate-key")
 	}
-	iTextResponse(s, i, "Allowed subcommands: check, refresh, new")
 }
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Tnze/go-mc/bot"
+	"github.com/Tnze/go-mc/bot/basic"
+	"github.com/Tnze/go-mc/data/packetid"
+	pk "github.com/Tnze/go-mc/net/packet"
+	"github.com/bwmarrin/discordgo"
+)
+
+// Connection states of a live bot
+const (
+	botStateConnecting   = "connecting"
+	botStateQueue        = "in queue"
+	botStateInGame       = "in game"
+	botStateDisconnected = "disconnected"
+)
+
+// liveBot is a running Minecraft client as shown by /bots
+type liveBot struct {
+	ID       int
+	Room     PearlRoom
+	Server   string
+	Since    time.Time
+	username string
+	client   *bot.Client
+
+	lock   sync.Mutex
+	state  string
+	queue  int
+	pos    [3]float64
+	health float32
+}
+
+var (
+	liveBots       = map[int]*liveBot{}
+	liveBotsLock   sync.Mutex
+	liveBotsLastID int
+)
+
+// registerBot adds client to the registry and starts tracking its state,
+// it must be called before client joins the server
+func registerBot(c *bot.Client, p *basic.Player, room PearlRoom) *liveBot {
+	liveBotsLock.Lock()
+	defer liveBotsLock.Unlock()
+	liveBotsLastID++
+	b := &liveBot{
+		ID:       liveBotsLastID,
+		Room:     room,
+		Server:   room.ServerAdress,
+		Since:    time.Now(),
+		client:   c,
+		username: c.Auth.Name,
+		state:    botStateConnecting,
+	}
+	c.Events.AddListener(
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundPlayerPosition, F: b.onPlayerPosition},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundSetHealth, F: b.onSetHealth},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundDisconnect, F: b.onDisconnect},
+	)
+	joinListener{
+		Player: p,
+		InGame: func() error {
+			b.setState(botStateInGame)
+			return nil
+		},
+		Queue: func(q queueStatus) error {
+			b.lock.Lock()
+			b.state = botStateQueue
+			b.queue = q.Position
+			b.lock.Unlock()
+			return nil
+		},
+	}.Attach(c)
+	liveBots[b.ID] = b
+	return b
+}
+
+// unregister removes bot from the registry once its client is closed
+func (b *liveBot) unregister() {
+	liveBotsLock.Lock()
+	defer liveBotsLock.Unlock()
+	delete(liveBots, b.ID)
+}
+
+func (b *liveBot) setState(state string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.state = state
+}
+
+// disconnect closes connection of the client, persistent session will
+// reconnect after a while
+func (b *liveBot) disconnect() error {
+	b.setState(botStateDisconnected)
+	return b.client.Close()
+}
+
+func (b *liveBot) onPlayerPosition(p pk.Packet) error {
+	var (
+		X, Y, Z    pk.Double
+		Yaw, Pitch pk.Float
+		Flags      pk.Byte
+	)
+	if err := p.Scan(&X, &Y, &Z, &Yaw, &Pitch, &Flags); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// flags mark coordinates that are relative to the current position
+	for i, v := range []pk.Double{X, Y, Z} {
+		if Flags&(1<<i) != 0 {
+			b.pos[i] += float64(v)
+		} else {
+			b.pos[i] = float64(v)
+		}
+	}
+	return nil
+}
+
+func (b *liveBot) onSetHealth(p pk.Packet) error {
+	var health pk.Float
+	if err := p.Scan(&health); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.health = float32(health)
+	return nil
+}
+
+func (b *liveBot) onDisconnect(_ pk.Packet) error {
+	b.setState(botStateDisconnected)
+	return nil
+}
+
+func (b *liveBot) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state := b.state
+	if state == botStateQueue && b.queue > 0 {
+		state += " at " + strconv.Itoa(b.queue)
+	}
+	ret := fmt.Sprintf("`#%d` room `%s` %s on `%s`: %s", b.ID, b.Room.RoomName, usernameBeautify(b.username), b.Server, state)
+	if b.state == botStateInGame {
+		ret += fmt.Sprintf(" at %.1f %.1f %.1f, health %.1f", b.pos[0], b.pos[1], b.pos[2], b.health)
+	}
+	return ret + fmt.Sprintf(", connected <t:%d:R>", b.Since.Unix())
+}
+
+func listLiveBots() []*liveBot {
+	liveBotsLock.Lock()
+	defer liveBotsLock.Unlock()
+	ret := []*liveBot{}
+	for _, b := range liveBots {
+		ret = append(ret, b)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+func findLiveBot(id int) *liveBot {
+	liveBotsLock.Lock()
+	defer liveBotsLock.Unlock()
+	return liveBots[id]
+}
+
+func commandBots(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	cmd := i.ApplicationCommandData().Options[0]
+	switch cmd.Name {
+	case "list":
+		bots := listLiveBots()
+		if len(bots) == 0 {
+			iTextResponse(s, i, "No bots are online")
+			return
+		}
+		resp := ""
+		for _, b := range bots {
+			resp += b.String() + "\n"
+		}
+		iQuietTextResponse(s, i, resp)
+	case "disconnect":
+		opts := optionsMap(cmd.Options)
+		b := findLiveBot(int(opts["id"].IntValue()))
+		if b == nil {
+			iTextResponse(s, i, "Bot not found, check `/bots list`")
+			return
+		}
+		userID := interactionUserID(i)
+		if b.Room.AccountOwner != "" && b.Room.AccountOwner != userID {
+			iTextResponse(s, i, "Only owner of room `"+b.Room.RoomName+"` can disconnect its bot")
+			return
+		}
+		err := b.disconnect()
+		e := auditEntry{Action: "bot disconnect", User: userID, Room: b.Room.RoomName, Result: "ok", Detail: b.username}
+		if err != nil {
+			e.Result = "failed"
+			e.Detail = err.Error()
+		}
+		writeAudit(s, e)
+		if err != nil {
+			iTextResponse(s, i, "Failed to disconnect: "+err.Error())
+			return
+		}
+		resp := fmt.Sprintf("Bot `#%d` of room `%s` disconnected", b.ID, b.Room.RoomName)
+		if b.Room.StayLoggedIn {
+			resp += ", session will reconnect after a while"
+		}
+		iTextResponse(s, i, resp)
+	default:
+		iTextResponse(s, i, "Allowed subcommands: list, disconnect")
+	}
+}
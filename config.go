@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"log"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
 type Chamber struct {
-	Index int       `json:"index"`
-	Pos   []float64 `json:"pos"`
+	Index        int       `json:"index"`
+	Pos          []float64 `json:"pos"`
+	Mechanism    string    `json:"mechanism"`
+	Face         string    `json:"face"`
+	Facing       string    `json:"facing"`
+	Label        string    `json:"label"`
+	Owner        string    `json:"ownerDiscordId"`
+	AllowedUsers []string  `json:"allowedUsers"`
 }
 type PearlRoom struct {
 	Chambers               []Chamber `json:"chambers"`
@@ -21,103 +28,230 @@ type PearlRoom struct {
 	RoomName               string    `json:"roomName"`
 	ServerAdress           string    `json:"serverAdress"`
 	BotPos                 []float64 `json:"botPos"`
+	StayLoggedIn           bool      `json:"stayLoggedIn"`
+	ActivationTimeout      int       `json:"activationTimeout"`
+	ActivationRetries      int       `json:"activationRetries"`
+	SharedChambers         bool      `json:"sharedChambers"`
 }
 type BotConfiguration struct {
-	RemoveUnmetMessages         bool        `json:"removeUnmet"`
-	RemoveUnmetIgnore           []string    `json:"removeIgnore"`
-	PearlRooms                  []PearlRoom `json:"rooms"`
-	DiscordToken                string      `json:"discordToken"`
-	DiscordServiceChannel       string      `json:"discordServiceChannel"`
-	AccountsCredentialCachePath string      `json:"accountsCredentialsCachePath"`
-	MicrosoftCID                string      `json:"microsoftCID"`
-	GuildID                     string      `json:"guildID"`
-	StatusQueryRegion1          string      `json:"statusRegion1"`
-	StatusQueryRegion2          string      `json:"statusRegion2"`
+	Version                     int                `json:"version"`
+	RemoveUnmetMessages         bool               `json:"removeUnmet"`
+	RemoveUnmetIgnore           []string           `json:"removeIgnore"`
+	PearlRooms                  []PearlRoom        `json:"rooms"`
+	DiscordToken                string             `json:"discordToken"`
+	DiscordServiceChannel       string             `json:"discordServiceChannel"`
+	AccountsCredentialCachePath string             `json:"accountsCredentialsCachePath"`
+	MicrosoftCID                string             `json:"microsoftCID"`
+	GuildID                     string             `json:"guildID"`
+	StatusQueryRegion1          string             `json:"statusRegion1"`
+	StatusQueryRegion2          string             `json:"statusRegion2"`
+	StatusXboxURL               string             `json:"statusXboxURL"`
+	StatusMinecraftServicesURL  string             `json:"statusMinecraftServicesURL"`
+	StatusSessionServerURL      string             `json:"statusSessionServerURL"`
+	Permissions                 *PermissionsConfig `json:"permissions"`
+	AuditLogPath                string             `json:"auditLogPath"`
+	TokenRefreshInterval        int                `json:"tokenRefreshInterval"`
+	CredentialsKeyFile          string             `json:"credentialsKeyFile"`
+	CredentialsStore            string             `json:"credentialsStore"`
+	CredentialsDatabase         string             `json:"credentialsDatabase"`
+	ConfigHistoryPath           string             `json:"configHistoryPath"`
+	ConfigHistoryKeep           int                `json:"configHistoryKeep"`
+	// values overridden by environment or flags as they are in the file
+	fileValues map[int]string
 }
 
-var (
-	config *BotConfiguration
-)
+const defaultActivationTimeout = 30 * time.Minute
 
-const (
-	configPath string = "./config.json"
-)
+// activationTimeout is how long activation may take including time
+// spent in queue, configured in seconds
+func (r PearlRoom) activationTimeout() time.Duration {
+	if r.ActivationTimeout <= 0 {
+		return defaultActivationTimeout
+	}
+	return time.Duration(r.ActivationTimeout) * time.Second
+}
 
+// loadConfig reads and verifies config and swaps current one with it,
+// credentials store and key are set up for the new config
 func loadConfig() error {
-	configf, err := os.Open(configPath)
+	state.configEdit.Lock()
+	defer state.configEdit.Unlock()
+	conf, err := readConfigFile(configPath)
 	if err != nil {
 		return err
 	}
-	defer configf.Close()
-	configb, err := ioutil.ReadAll(configf)
+	applyConfigOverrides(conf)
+	err = verifyConfig(conf)
+	if err != nil {
+		return fmt.Errorf("verification failed: %w", err)
+	}
+	first := getConfig() == nil
+	oldKey := currentCredentialsKey()
+	err = applyConfig(conf)
 	if err != nil {
 		return err
 	}
-	var conf BotConfiguration
-	err = json.Unmarshal(configb, &conf)
+	return reencryptChangedCredentials(conf, oldKey, first)
+}
+
+// reencryptChangedCredentials encrypts credentials with key of config that
+// was just applied if key changed, on startup everything is checked
+func reencryptChangedCredentials(conf *BotConfiguration, oldKey []byte, always bool) error {
+	if !always && bytes.Equal(oldKey, currentCredentialsKey()) {
+		return nil
+	}
+	err := reencryptCredentials(conf, oldKey)
+	if err != nil {
+		return fmt.Errorf("config is applied, but credentials were not encrypted with its key: %w", err)
+	}
+	return nil
+}
+
+// preparedConfig is verified config with credentials store opened and
+// key read, nothing is changed until it is applied
+type preparedConfig struct {
+	conf    *BotConfiguration
+	store   *preparedStore
+	key     []byte
+	prevKey []byte
+}
+
+func prepareConfig(conf *BotConfiguration) (*preparedConfig, error) {
+	key, prevKey, err := readCredentialsKey(conf)
+	if err != nil {
+		return nil, err
+	}
+	store, err := prepareCredentialsStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedConfig{conf: conf, store: store, key: key, prevKey: prevKey}, nil
+}
+
+// apply makes prepared config current, it can not fail
+func (p *preparedConfig) apply() {
+	p.store.use()
+	setCredentialsKey(p.key, p.prevKey)
+	setConfig(p.conf)
+}
+
+func (p *preparedConfig) discard() {
+	p.store.discard()
+}
+
+// applyConfig sets up credentials store and key for verified config and
+// makes it current
+func applyConfig(conf *BotConfiguration) error {
+	p, err := prepareConfig(conf)
 	if err != nil {
 		return err
 	}
-	config = &conf
+	p.apply()
 	return nil
 }
 
-func saveConfig() error {
-	conf, err := json.MarshalIndent(config, "", "\t")
+// saveConfig replaces config file atomically, previous one is kept in history
+func saveConfig(conf *BotConfiguration) error {
+	confb, err := encodeConfig(configPath, withoutConfigOverrides(conf))
+	if err != nil {
+		return err
+	}
+	err = archiveConfig(conf.configHistoryPath())
+	if err != nil {
+		return fmt.Errorf("archiving previous config: %w", err)
+	}
+	err = writeFileAtomic(configPath, confb, 0664)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile("./config.json", conf, 0664)
+	err = pruneConfigHistory(conf.configHistoryPath(), conf.configHistoryKeep())
+	if err != nil {
+		log.Printf("Failed to prune config history: %v", err)
+	}
+	return nil
 }
 
-func verifyConfig() error {
-	for i, c := range config.PearlRooms {
-		sharedChannel := false
-		for ii := i + 1; ii < len(config.PearlRooms); ii++ {
-			cc := config.PearlRooms[ii]
-			if c.AccountCredentialsName == cc.AccountCredentialsName {
-				return fmt.Errorf("room %s and %s have same account credentials name",
-					c.AccountCredentialsName, cc.AccountCredentialsName)
-			}
-			if c.DiscordChannel == cc.DiscordChannel {
-				sharedChannel = true
-			}
-			if c.DiscordChannel == cc.DiscordChannel && c.RoomName == cc.RoomName {
-				return fmt.Errorf("room %s have same name and discord channel, remove or rename", c.RoomName)
-			}
-		}
-		if c.RoomName == "" && sharedChannel {
-			return fmt.Errorf("empty pearl room name assigned to shared channel")
-		}
-		if len(c.BotPos) != 3 {
-			return fmt.Errorf("bot position is not 3 floats")
-		}
+// editConfig applies edit to a copy of current config and replaces current
+// config with it only if it passes verification and gets saved
+func editConfig(edit func(conf *BotConfiguration) error) error {
+	state.configEdit.Lock()
+	defer state.configEdit.Unlock()
+	confb, err := json.Marshal(getConfig())
+	if err != nil {
+		return err
+	}
+	var conf BotConfiguration
+	err = json.Unmarshal(confb, &conf)
+	if err != nil {
+		return err
+	}
+	conf.fileValues = getConfig().fileValues
+	err = edit(&conf)
+	if err != nil {
+		return err
+	}
+	err = verifyConfig(&conf)
+	if err != nil {
+		return err
 	}
+	err = saveConfig(&conf)
+	if err != nil {
+		return err
+	}
+	setConfig(&conf)
 	return nil
 }
 
 func commandConfig(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	cmd := i.ApplicationCommandData().Options[0].Name
-	if cmd == "load" {
-		err := loadConfig()
+	detail := ""
+	audit := func(err error) {
+		e := auditEntry{Action: "config " + cmd, User: interactionUserID(i), Result: "ok", Detail: detail}
 		if err != nil {
-			iTextResponse(s, i, "Error loading config: "+err.Error())
-			return
+			e.Result = "failed"
+			e.Detail = err.Error()
 		}
-		err = verifyConfig()
+		writeAudit(s, e)
+	}
+	switch cmd {
+	case "load":
+		err := loadConfig()
+		audit(err)
 		if err != nil {
-			iTextResponse(s, i, "Error verifying config: "+err.Error())
+			iTextResponse(s, i, "Error loading config: "+err.Error())
 			return
 		}
+		syncRoomSessions(s)
 		iTextResponse(s, i, "Config loaded.")
-	}
-	if cmd == "save" {
-		err := saveConfig()
+	case "save":
+		state.configEdit.Lock()
+		err := saveConfig(getConfig())
+		state.configEdit.Unlock()
+		audit(err)
 		if err != nil {
 			iTextResponse(s, i, "Error saving config: "+err.Error())
 			return
 		}
 		iTextResponse(s, i, "Config saved.")
+	case "history":
+		versions, err := listConfigHistory(getConfig().configHistoryPath())
+		if err != nil {
+			iTextResponse(s, i, "Error reading config history: "+err.Error())
+			return
+		}
+		iTextResponse(s, i, configHistoryString(versions))
+	case "rollback":
+		version := optionString(optionsMap(i.ApplicationCommandData().Options[0].Options), "version")
+		detail = "version " + version
+		err := rollbackConfig(version)
+		audit(err)
+		if err != nil {
+			iTextResponse(s, i, "Error rolling back config: "+err.Error())
+			return
+		}
+		syncRoomSessions(s)
+		iTextResponse(s, i, "Config rolled back to version `"+version+"`.")
+	default:
+		iTextResponse(s, i, "Usage: `/config (load|save|history|rollback)`")
 	}
-	iTextResponse(s, i, "Usage: `/config (load|save)`")
 }
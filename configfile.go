@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configPath = "./config.json"
+	// credentialsDirectory is set by -credentials flag
+	credentialsDirectory string
+)
+
+// configFormat is a config file syntax, YAML and TOML are converted
+// to and from JSON so json tags stay the only names of config fields
+type configFormat struct {
+	unmarshal func(data []byte, v interface{}) error
+	marshal   func(v interface{}) ([]byte, error)
+}
+
+var configFormats = map[string]configFormat{
+	".json": {json.Unmarshal, func(v interface{}) ([]byte, error) {
+		return json.MarshalIndent(v, "", "\t")
+	}},
+	".yaml": {yaml.Unmarshal, yaml.Marshal},
+	".yml":  {yaml.Unmarshal, yaml.Marshal},
+	".toml": {toml.Unmarshal, func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		err := toml.NewEncoder(&buf).Encode(v)
+		return buf.Bytes(), err
+	}},
+}
+
+// configFormatOf picks format by file extension, JSON is the default
+func configFormatOf(path string) configFormat {
+	if f, ok := configFormats[strings.ToLower(filepath.Ext(path))]; ok {
+		return f
+	}
+	return configFormats[".json"]
+}
+
+// jsonCompatible converts decoded YAML to something encoding/json accepts
+// and drops nulls that TOML has no way to express
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, vv := range v {
+			if vv == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = jsonCompatible(vv)
+		}
+		return v
+	case map[interface{}]interface{}:
+		ret := map[string]interface{}{}
+		for k, vv := range v {
+			if vv != nil {
+				ret[fmt.Sprint(k)] = jsonCompatible(vv)
+			}
+		}
+		return ret
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonCompatible(v[i])
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return v
+}
+
+// decodeConfig migrates config to current schema version, unknown fields
+// are errors because they would be silently dropped otherwise
+func decodeConfig(path string, data []byte) (*BotConfiguration, error) {
+	var m map[string]interface{}
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" && configFormats[ext].unmarshal != nil {
+		err := configFormats[ext].unmarshal(data, &m)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		err := d.Decode(&m)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	jsonCompatible(m)
+	from, err := migrateConfig(m)
+	if err != nil {
+		return nil, err
+	}
+	if from != configSchemaVersion {
+		log.Printf("Config %s was migrated from schema version %d to %d, save it to keep the new shape", path, from, configSchemaVersion)
+	}
+	err = checkConfigFields(m)
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var conf BotConfiguration
+	err = json.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+func encodeConfig(path string, conf *BotConfiguration) ([]byte, error) {
+	format := configFormatOf(path)
+	data, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	err = d.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+	return format.marshal(jsonCompatible(m))
+}
+
+// readConfigFile reads config in format of the file, nothing is overridden
+func readConfigFile(path string) (*BotConfiguration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := decodeConfig(path, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// configOverride replaces config value with one from environment or
+// command line, overridden values are never written to config file
+type configOverride struct {
+	source string
+	value  func() string
+	field  func(c *BotConfiguration) *string
+}
+
+func envOverride(name string, field func(c *BotConfiguration) *string) configOverride {
+	return configOverride{
+		source: name + " environment variable",
+		value:  func() string { return os.Getenv(name) },
+		field:  field,
+	}
+}
+
+var configOverrides = []configOverride{
+	envOverride("DiscordToken", func(c *BotConfiguration) *string { return &c.DiscordToken }),
+	envOverride("MicrosoftCID", func(c *BotConfiguration) *string { return &c.MicrosoftCID }),
+	envOverride("GuildID", func(c *BotConfiguration) *string { return &c.GuildID }),
+	{
+		source: "-credentials flag",
+		value:  func() string { return credentialsDirectory },
+		field:  func(c *BotConfiguration) *string { return &c.AccountsCredentialCachePath },
+	},
+}
+
+// applyConfigOverrides sets overridden values of config that was just
+// read, values from the file are remembered so saves can put them back
+func applyConfigOverrides(conf *BotConfiguration) {
+	conf.fileValues = map[int]string{}
+	for i, o := range configOverrides {
+		v := o.value()
+		if v == "" {
+			continue
+		}
+		f := o.field(conf)
+		conf.fileValues[i] = *f
+		*f = v
+		log.Printf("Config value is overridden by %s", o.source)
+	}
+}
+
+// withoutConfigOverrides returns copy of config with values from the file
+// in place of overridden ones
+func withoutConfigOverrides(conf *BotConfiguration) *BotConfiguration {
+	ret := *conf
+	for i, v := range conf.fileValues {
+		*configOverrides[i].field(&ret) = v
+	}
+	return &ret
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFormatsRoundTrip(t *testing.T) {
+	example, err := readConfigFile("example_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ext := range []string{".json", ".yaml", ".yml", ".toml", ".conf"} {
+		path := filepath.Join(t.TempDir(), "config"+ext)
+		data, err := encodeConfig(path, example)
+		if err != nil {
+			t.Errorf("%s: %v", ext, err)
+			continue
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := readConfigFile(path)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", ext, err, data)
+			continue
+		}
+		if !reflect.DeepEqual(got, example) {
+			t.Errorf("%s: config changed in round trip:\n%+v\nwant\n%+v", ext, got, example)
+		}
+	}
+}
+
+func TestConfigFormatOf(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"config.json", ".json"},
+		{"config.YAML", ".yaml"},
+		{"config.yml", ".yml"},
+		{"dir.toml/config.toml", ".toml"},
+		{"config", ".json"},
+		{"config.txt", ".json"},
+	}
+	for _, tt := range tests {
+		got := reflect.ValueOf(configFormatOf(tt.path).marshal).Pointer()
+		want := reflect.ValueOf(configFormats[tt.want].marshal).Pointer()
+		if got != want {
+			t.Errorf("%s is not read as %s", tt.path, tt.want)
+		}
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := []byte("discordToken: file token\nmicrosoftCID: file cid\naccountsCredentialsCachePath: ./file\n")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DiscordToken", "env token")
+	t.Setenv("MicrosoftCID", "")
+	prev := credentialsDirectory
+	credentialsDirectory = "./flag"
+	t.Cleanup(func() { credentialsDirectory = prev })
+
+	conf, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyConfigOverrides(conf)
+	if conf.DiscordToken != "env token" {
+		t.Errorf("environment did not override file, token is %q", conf.DiscordToken)
+	}
+	if conf.MicrosoftCID != "file cid" {
+		t.Errorf("empty environment variable overrode file, cid is %q", conf.MicrosoftCID)
+	}
+	if conf.AccountsCredentialCachePath != "./flag" {
+		t.Errorf("flag did not override file, credentials directory is %q", conf.AccountsCredentialCachePath)
+	}
+
+	// saved config keeps values of the file
+	file := withoutConfigOverrides(conf)
+	if file.DiscordToken != "file token" || file.AccountsCredentialCachePath != "./file" {
+		t.Errorf("overridden values would be saved: %q %q", file.DiscordToken, file.AccountsCredentialCachePath)
+	}
+	if conf.DiscordToken != "env token" {
+		t.Error("saving changed config in use")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConfigHistoryPath = "./config.history"
+	defaultConfigHistoryKeep = 10
+	configVersionTimeFormat  = "20060102-150405.000"
+)
+
+func (c *BotConfiguration) configHistoryPath() string {
+	if c.ConfigHistoryPath == "" {
+		return defaultConfigHistoryPath
+	}
+	return c.ConfigHistoryPath
+}
+
+func (c *BotConfiguration) configHistoryKeep() int {
+	if c.ConfigHistoryKeep <= 0 {
+		return defaultConfigHistoryKeep
+	}
+	return c.ConfigHistoryKeep
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, readers see either old or new content and never a part
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	fail := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return fail(err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return fail(err)
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// configVersion is a config file that was replaced by a save
+type configVersion struct {
+	Name string
+	Time time.Time
+	path string
+}
+
+// archiveConfig copies config file that is about to be replaced to
+// history, version is named after the time it was saved
+func archiveConfig(dir string) error {
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	name := info.ModTime().Format(configVersionTimeFormat)
+	ext := filepath.Ext(configPath)
+	path := filepath.Join(dir, "config-"+name+ext)
+	for n := 1; ; n++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		}
+		path = filepath.Join(dir, fmt.Sprintf("config-%s-%d%s", name, n, ext))
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// listConfigHistory returns saved versions, newest first
+func listConfigHistory(dir string) ([]configVersion, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ret := []configVersion{}
+	for _, e := range entries {
+		n := e.Name()
+		if e.IsDir() || !strings.HasPrefix(n, "config-") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(n, "config-"), filepath.Ext(n))
+		if len(name) < len(configVersionTimeFormat) {
+			continue
+		}
+		t, err := time.ParseInLocation(configVersionTimeFormat, name[:len(configVersionTimeFormat)], time.Local)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, configVersion{Name: name, Time: t, path: filepath.Join(dir, n)})
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Time.Equal(ret[j].Time) {
+			return ret[i].Name > ret[j].Name
+		}
+		return ret[i].Time.After(ret[j].Time)
+	})
+	return ret, nil
+}
+
+// pruneConfigHistory removes everything but keep newest versions
+func pruneConfigHistory(dir string, keep int) error {
+	versions, err := listConfigHistory(dir)
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(versions); i++ {
+		if err := os.Remove(versions[i].path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findConfigVersion(dir, name string) (configVersion, error) {
+	versions, err := listConfigHistory(dir)
+	if err != nil {
+		return configVersion{}, err
+	}
+	for _, v := range versions {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return configVersion{}, fmt.Errorf("config version %s not found", name)
+}
+
+// rollbackConfig verifies and applies saved version, config it replaces
+// goes to history so rollback can be undone the same way
+func rollbackConfig(name string) error {
+	state.configEdit.Lock()
+	defer state.configEdit.Unlock()
+	v, err := findConfigVersion(getConfig().configHistoryPath(), name)
+	if err != nil {
+		return err
+	}
+	conf, err := readConfigFile(v.path)
+	if err != nil {
+		return fmt.Errorf("version %s is malformed: %w", name, err)
+	}
+	applyConfigOverrides(conf)
+	err = verifyConfig(conf)
+	if err != nil {
+		return fmt.Errorf("version %s failed verification: %w", name, err)
+	}
+	// store and key are ready before anything is written, so a version
+	// that can not be applied does not end up in the config file
+	p, err := prepareConfig(conf)
+	if err != nil {
+		return fmt.Errorf("version %s can not be applied: %w", name, err)
+	}
+	err = saveConfig(conf)
+	if err != nil {
+		p.discard()
+		return err
+	}
+	oldKey := currentCredentialsKey()
+	p.apply()
+	return reencryptChangedCredentials(conf, oldKey, false)
+}
+
+func configHistoryString(versions []configVersion) string {
+	if len(versions) == 0 {
+		return "No saved config versions"
+	}
+	ret := "Saved config versions, newest first:"
+	for _, v := range versions {
+		ret += fmt.Sprintf("\n`%s` <t:%d:R>", v.Name, v.Time.Unix())
+	}
+	return ret
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollbackConfigNotApplicable(t *testing.T) {
+	dir := t.TempDir()
+	history := filepath.Join(dir, "history")
+	prevPath, prevConfig := configPath, getConfig()
+	configPath = filepath.Join(dir, "config.json")
+	t.Cleanup(func() {
+		configPath = prevPath
+		setConfig(prevConfig)
+		closeCredentialsStore()
+	})
+
+	current := &BotConfiguration{CredentialsStore: credentialsStoreMemory, ConfigHistoryPath: history, GuildID: "123456789012345678"}
+	if err := applyConfig(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveConfig(current); err != nil {
+		t.Fatal(err)
+	}
+	currentData, err := os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bbolt can not create database in a directory that does not exist
+	broken := &BotConfiguration{CredentialsStore: credentialsStoreBolt, CredentialsDatabase: filepath.Join(dir, "missing", "credentials.db"), ConfigHistoryPath: history}
+	data, err := encodeConfig(configPath, broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(history, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(history, "config-20200101-000000.000.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rollbackConfig("20200101-000000.000"); err == nil {
+		t.Fatal("rollback to version with broken credentials store succeeded")
+	}
+	data, err = os.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(currentData) {
+		t.Errorf("config file was replaced by version that was not applied:\n%s", data)
+	}
+	if getConfig() != current {
+		t.Error("current config was replaced")
+	}
+	err = useCredentialsStore(func(store credentialsStore) error {
+		if _, ok := store.(*memoryStore); !ok {
+			t.Errorf("credentials store was replaced with %T", store)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
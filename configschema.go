@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configSchemaVersion is the version of config shape this build reads
+// and writes, configs without version are version 0
+const configSchemaVersion = 1
+
+// configMigrations[n] turns config of version n into version n+1, it works
+// on decoded config before it gets to BotConfiguration so old fields are
+// still there
+var configMigrations = []func(m map[string]interface{}) error{
+	migrateChamberCoordinates,
+}
+
+func configNumber(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// migrateChamberCoordinates replaces separate chamber x, y and z with pos
+func migrateChamberCoordinates(m map[string]interface{}) error {
+	rooms, _ := m["rooms"].([]interface{})
+	for ri, r := range rooms {
+		room, _ := r.(map[string]interface{})
+		chambers, _ := room["chambers"].([]interface{})
+		for ci, c := range chambers {
+			chamber, _ := c.(map[string]interface{})
+			_, hasX := chamber["x"]
+			_, hasY := chamber["y"]
+			_, hasZ := chamber["z"]
+			if !hasX && !hasY && !hasZ {
+				continue
+			}
+			path := fmt.Sprintf("rooms[%d].chambers[%d]", ri, ci)
+			if _, ok := chamber["pos"]; ok {
+				return &ErrorConfigField{path, errors.New("both pos and x, y, z are set")}
+			}
+			pos := []interface{}{}
+			for _, k := range []string{"x", "y", "z"} {
+				n, ok := configNumber(chamber[k])
+				if !ok {
+					return &ErrorConfigField{path + "." + k, errors.New("coordinate is missing or not a number")}
+				}
+				pos = append(pos, n)
+				delete(chamber, k)
+			}
+			chamber["pos"] = pos
+		}
+	}
+	return nil
+}
+
+// migrateConfig brings decoded config to current schema version and
+// tells which version it was
+func migrateConfig(m map[string]interface{}) (int, error) {
+	version := 0
+	if v, ok := m["version"]; ok {
+		n, ok := configNumber(v)
+		if !ok || n != float64(int(n)) || n < 0 {
+			return 0, &ErrorConfigField{"version", fmt.Errorf("`%v` is not a schema version", v)}
+		}
+		version = int(n)
+	}
+	if version > configSchemaVersion {
+		return version, &ErrorConfigField{"version", fmt.Errorf("schema version %d is newer than supported %d", version, configSchemaVersion)}
+	}
+	for v := version; v < configSchemaVersion; v++ {
+		if err := configMigrations[v](m); err != nil {
+			return version, fmt.Errorf("migrating from schema version %d: %w", v, err)
+		}
+	}
+	m["version"] = configSchemaVersion
+	return version, nil
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// unknownConfigFields lists locations of values that t has no field for,
+// field names are matched ignoring case the same way encoding/json does
+func unknownConfigFields(v interface{}, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	ret := []string{}
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			fields[strings.ToLower(name)] = f.Type
+		}
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ft, ok := fields[strings.ToLower(k)]
+			if !ok {
+				ret = append(ret, joinConfigPath(path, k))
+				continue
+			}
+			ret = append(ret, unknownConfigFields(m[k], ft, joinConfigPath(path, k))...)
+		}
+	case reflect.Slice:
+		s, _ := v.([]interface{})
+		for i, e := range s {
+			ret = append(ret, unknownConfigFields(e, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	case reflect.Map:
+		m, _ := v.(map[string]interface{})
+		for k, e := range m {
+			ret = append(ret, unknownConfigFields(e, t.Elem(), fmt.Sprintf("%s[%s]", path, k))...)
+		}
+		sort.Strings(ret)
+	}
+	return ret
+}
+
+// checkConfigFields reports fields that would be silently dropped
+func checkConfigFields(m map[string]interface{}) error {
+	unknown := unknownConfigFields(m, reflect.TypeOf(BotConfiguration{}), "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	problems := []*ErrorConfigField{}
+	for _, path := range unknown {
+		problems = append(problems, &ErrorConfigField{path, errors.New("unknown field")})
+	}
+	return &ErrorConfigInvalid{problems}
+}
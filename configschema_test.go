@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConfigLegacyChambers(t *testing.T) {
+	legacy := `{
+	"rooms": [{
+		"accountCredentialsName": "acc",
+		"chambers": [
+			{"index": 1, "x": 10, "y": 64, "z": -5},
+			{"index": 2, "x": 11.5, "y": 65, "z": -6}
+		]
+	}]
+}`
+	conf, err := decodeConfig("config.json", []byte(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Version != configSchemaVersion {
+		t.Errorf("got version %d, want %d", conf.Version, configSchemaVersion)
+	}
+	chambers := conf.PearlRooms[0].Chambers
+	want := [][]float64{{10, 64, -5}, {11.5, 65, -6}}
+	for i, c := range chambers {
+		if !reflect.DeepEqual(c.Pos, want[i]) {
+			t.Errorf("chambers[%d] got pos %v, want %v", i, c.Pos, want[i])
+		}
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   map[string]interface{}
+		from     int
+		wantPath string
+	}{
+		{"current version is left as is", map[string]interface{}{
+			"version": int64(configSchemaVersion),
+			"rooms": []interface{}{map[string]interface{}{
+				"chambers": []interface{}{map[string]interface{}{"pos": []interface{}{int64(1), int64(2), int64(3)}}},
+			}},
+		}, configSchemaVersion, ""},
+		{"legacy coordinates", map[string]interface{}{
+			"rooms": []interface{}{map[string]interface{}{
+				"chambers": []interface{}{map[string]interface{}{"x": int64(1), "y": int64(2), "z": int64(3)}},
+			}},
+		}, 0, ""},
+		{"both pos and coordinates", map[string]interface{}{
+			"rooms": []interface{}{map[string]interface{}{
+				"chambers": []interface{}{map[string]interface{}{"x": int64(1), "y": int64(2), "z": int64(3), "pos": []interface{}{}}},
+			}},
+		}, 0, "rooms[0].chambers[0]"},
+		{"missing coordinate", map[string]interface{}{
+			"rooms": []interface{}{map[string]interface{}{
+				"chambers": []interface{}{map[string]interface{}{"x": int64(1), "y": int64(2)}},
+			}},
+		}, 0, "rooms[0].chambers[0].z"},
+		{"newer version", map[string]interface{}{"version": int64(configSchemaVersion + 1)}, configSchemaVersion + 1, "version"},
+	}
+	for _, tt := range tests {
+		from, err := migrateConfig(tt.config)
+		if from != tt.from {
+			t.Errorf("%s: got version %d, want %d", tt.name, from, tt.from)
+		}
+		if tt.wantPath != "" {
+			var field *ErrorConfigField
+			if !errors.As(err, &field) || field.Path != tt.wantPath {
+				t.Errorf("%s: got %v, want error at %s", tt.name, err, tt.wantPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		chamber := tt.config["rooms"].([]interface{})[0].(map[string]interface{})["chambers"].([]interface{})[0].(map[string]interface{})
+		if len(chamber) != 1 || len(chamber["pos"].([]interface{})) != 3 {
+			t.Errorf("%s: got chamber %v, want only pos", tt.name, chamber)
+		}
+	}
+}
+
+func TestDecodeConfigUnknownField(t *testing.T) {
+	_, err := decodeConfig("config.json", []byte(`{"version": 1, "discordTokn": "x", "rooms": [{"roomName": "a", "stayLogedIn": true}]}`))
+	var invalid *ErrorConfigInvalid
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got %v, want ErrorConfigInvalid", err)
+	}
+	got := []string{}
+	for _, p := range invalid.Problems {
+		got = append(got, p.Path)
+	}
+	want := []string{"discordTokn", "rooms[0].stayLogedIn"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got unknown fields %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrorConfigField is a problem with config value at location like
+// rooms[2].chambers[1].pos
+type ErrorConfigField struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrorConfigField) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *ErrorConfigField) Unwrap() error {
+	return e.Err
+}
+
+// ErrorConfigInvalid lists every problem found in config
+type ErrorConfigInvalid struct {
+	Problems []*ErrorConfigField
+}
+
+func (e *ErrorConfigInvalid) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0].Error()
+	}
+	ret := fmt.Sprintf("%d problems in config:", len(e.Problems))
+	for _, p := range e.Problems {
+		ret += "\n" + p.Error()
+	}
+	return ret
+}
+
+// configVerifier collects problems instead of stopping at the first one
+type configVerifier struct {
+	problems []*ErrorConfigField
+}
+
+func (v *configVerifier) fail(path string, err error) {
+	v.problems = append(v.problems, &ErrorConfigField{path, err})
+}
+
+func (v *configVerifier) failf(path, format string, args ...interface{}) {
+	v.fail(path, fmt.Errorf(format, args...))
+}
+
+var (
+	snowflakeRegexp = regexp.MustCompile(`^[0-9]{17,20}$`)
+	hostnameRegexp  = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?(\.[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?)*\.?$`)
+)
+
+func isSnowflake(id string) bool {
+	if !snowflakeRegexp.MatchString(id) {
+		return false
+	}
+	_, err := strconv.ParseUint(id, 10, 64)
+	return err == nil
+}
+
+// snowflake checks Discord ID, empty one is fine unless required
+func (v *configVerifier) snowflake(path, id string, required bool) {
+	if id == "" {
+		if required {
+			v.failf(path, "Discord ID is not set")
+		}
+		return
+	}
+	if !isSnowflake(id) {
+		v.failf(path, "`%s` is not a Discord ID", id)
+	}
+}
+
+// verifyServerAddress accepts host or host:port, same as client join does
+func verifyServerAddress(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("server address is not set")
+	}
+	host := addr
+	if net.ParseIP(addr) == nil && strings.Contains(addr, ":") {
+		h, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("`%s` is not host[:port]: %w", addr, err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("`%s` has invalid port %s", addr, port)
+		}
+		host = h
+	}
+	if net.ParseIP(host) == nil && !hostnameRegexp.MatchString(host) {
+		return fmt.Errorf("`%s` is not a valid host", host)
+	}
+	return nil
+}
+
+func stringListed(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string][]string) []string {
+	ret := make([]string, 0, len(m))
+	for k := range m {
+		ret = append(ret, k)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (v *configVerifier) capabilities(path string, list []string) {
+	for i, c := range list {
+		if c != capabilityAll && !capabilityListed(allCapabilities, c) {
+			v.failf(fmt.Sprintf("%s[%d]", path, i), "unknown capability %s", c)
+		}
+	}
+}
+
+func (v *configVerifier) permissions(p *PermissionsConfig) {
+	if p == nil {
+		return
+	}
+	v.capabilities("permissions.everyone", p.Everyone)
+	for _, id := range sortedKeys(p.Roles) {
+		path := fmt.Sprintf("permissions.roles[%s]", id)
+		v.snowflake(path, id, true)
+		v.capabilities(path, p.Roles[id])
+	}
+	for _, id := range sortedKeys(p.Users) {
+		path := fmt.Sprintf("permissions.users[%s]", id)
+		v.snowflake(path, id, true)
+		v.capabilities(path, p.Users[id])
+	}
+}
+
+func (v *configVerifier) credentialsStore(conf *BotConfiguration) {
+	switch conf.credentialsStoreKind() {
+	case credentialsStoreDirectory:
+		dir := conf.AccountsCredentialCachePath
+		if dir == "" {
+			dir = "."
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			v.failf("accountsCredentialsCachePath", "credentials directory is not accessible: %w", err)
+		} else if !info.IsDir() {
+			v.failf("accountsCredentialsCachePath", "%s is not a directory", dir)
+		}
+	case credentialsStoreBolt, credentialsStoreMemory:
+	default:
+		v.failf("credentialsStore", "unknown credentials store %s", conf.CredentialsStore)
+	}
+}
+
+func (v *configVerifier) room(path string, room PearlRoom) {
+	if err := validateCredentialsName(room.AccountCredentialsName); err != nil {
+		v.fail(path+".accountCredentialsName", err)
+	}
+	v.snowflake(path+".discordChannel", room.DiscordChannel, true)
+	v.snowflake(path+".accountOwnerDiscordId", room.AccountOwner, false)
+	if err := verifyServerAddress(room.ServerAdress); err != nil {
+		v.fail(path+".serverAdress", err)
+	}
+	botPosOK := len(room.BotPos) == 3
+	if !botPosOK {
+		v.failf(path+".botPos", "bot position has %d coordinates instead of 3", len(room.BotPos))
+	}
+	indexes := map[int]int{}
+	labels := map[string]int{}
+	for ci, ch := range room.Chambers {
+		cpath := fmt.Sprintf("%s.chambers[%d]", path, ci)
+		if prev, ok := indexes[ch.Index]; ok {
+			v.failf(cpath+".index", "index %d is already used by chambers[%d]", ch.Index, prev)
+		} else {
+			indexes[ch.Index] = ci
+		}
+		_, mechanismOK := mechanisms[ch.mechanism()]
+		if !mechanismOK {
+			v.failf(cpath+".mechanism", "unknown mechanism %s", ch.Mechanism)
+		}
+		if ch.Face != "" && !stringListed(chamberFaces, ch.Face) {
+			v.failf(cpath+".face", "unknown face %s, use one of %s", ch.Face, strings.Join(chamberFaces, ", "))
+		}
+		if ch.Facing != "" && !stringListed(chamberFacings, ch.Facing) {
+			v.failf(cpath+".facing", "unknown facing %s, use one of %s", ch.Facing, strings.Join(chamberFacings, ", "))
+		}
+		if ch.Label != "" {
+			if _, err := strconv.Atoi(ch.Label); err == nil {
+				v.failf(cpath+".label", "numeric label %s looks like an index", ch.Label)
+			} else if prev, ok := labels[ch.Label]; ok {
+				v.failf(cpath+".label", "label %s is already used by chambers[%d]", ch.Label, prev)
+			} else {
+				labels[ch.Label] = ci
+			}
+		}
+		v.snowflake(cpath+".ownerDiscordId", ch.Owner, false)
+		for ui, u := range ch.AllowedUsers {
+			v.snowflake(fmt.Sprintf("%s.allowedUsers[%d]", cpath, ui), u, true)
+		}
+		if len(ch.Pos) != 3 {
+			v.failf(cpath+".pos", "chamber position has %d coordinates instead of 3", len(ch.Pos))
+		} else if botPosOK && mechanismOK {
+			if err := checkReach(room, ci); err != nil {
+				v.fail(cpath+".pos", err)
+			}
+		}
+	}
+}
+
+// verifyConfig checks everything that can be checked without connecting
+// anywhere, all problems are reported at once as ErrorConfigInvalid
+func verifyConfig(conf *BotConfiguration) error {
+	v := &configVerifier{}
+	v.permissions(conf.Permissions)
+	v.credentialsStore(conf)
+	v.snowflake("guildID", conf.GuildID, false)
+	v.snowflake("discordServiceChannel", conf.DiscordServiceChannel, false)
+	for i, id := range conf.RemoveUnmetIgnore {
+		v.snowflake(fmt.Sprintf("removeIgnore[%d]", i), id, true)
+	}
+	for i, room := range conf.PearlRooms {
+		path := fmt.Sprintf("rooms[%d]", i)
+		v.room(path, room)
+		sharedChannel := false
+		for ii := i + 1; ii < len(conf.PearlRooms); ii++ {
+			other := conf.PearlRooms[ii]
+			if room.AccountCredentialsName == other.AccountCredentialsName {
+				v.failf(path+".accountCredentialsName", "room %s and rooms[%d] %s use the same credentials %s",
+					room.RoomName, ii, other.RoomName, room.AccountCredentialsName)
+			}
+			if room.DiscordChannel == other.DiscordChannel {
+				sharedChannel = true
+				if room.RoomName == other.RoomName {
+					v.failf(path+".roomName", "rooms[%d] has the same name %s in the same channel", ii, room.RoomName)
+				}
+			}
+		}
+		if room.RoomName == "" && sharedChannel {
+			v.failf(path+".roomName", "room in a channel shared with other rooms has no name")
+		}
+	}
+	if len(v.problems) > 0 {
+		return &ErrorConfigInvalid{v.problems}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// validVerifyConfig passes verification, tests break it in different ways
+func validVerifyConfig(t *testing.T) *BotConfiguration {
+	return &BotConfiguration{
+		AccountsCredentialCachePath: t.TempDir(),
+		GuildID:                     "123456789012345678",
+		Permissions: &PermissionsConfig{
+			Everyone: []string{capabilityActivate},
+			Roles:    map[string][]string{"223456789012345678": {capabilityManageRooms}},
+		},
+		PearlRooms: []PearlRoom{{
+			RoomName:               "main",
+			AccountCredentialsName: "main",
+			DiscordChannel:         "323456789012345678",
+			ServerAdress:           "mc.example.com:25565",
+			BotPos:                 []float64{0.5, 64, 0.5},
+			Chambers: []Chamber{
+				{Index: 1, Pos: []float64{1, 64, 0}},
+				{Index: 2, Pos: []float64{-1, 64, 0}, Mechanism: "button", Face: faceWall, Facing: facingEast, Label: "alt"},
+			},
+		}, {
+			RoomName:               "other",
+			AccountCredentialsName: "other",
+			DiscordChannel:         "323456789012345678",
+			ServerAdress:           "127.0.0.1",
+			BotPos:                 []float64{100.5, 70, 100.5},
+			Chambers:               []Chamber{{Index: 1, Pos: []float64{101, 70, 100}}},
+		}},
+	}
+}
+
+func TestVerifyConfigProblems(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(c *BotConfiguration)
+		want []string
+	}{
+		{"valid", func(c *BotConfiguration) {}, nil},
+		{"guild", func(c *BotConfiguration) { c.GuildID = "guild" }, []string{"guildID"}},
+		{"capability", func(c *BotConfiguration) {
+			c.Permissions.Everyone = []string{capabilityActivate, "fly"}
+		}, []string{"permissions.everyone[1]"}},
+		{"role", func(c *BotConfiguration) {
+			c.Permissions.Roles["admins"] = []string{capabilityAll}
+		}, []string{"permissions.roles[admins]"}},
+		{"store", func(c *BotConfiguration) { c.CredentialsStore = "s3" }, []string{"credentialsStore"}},
+		{"bot position", func(c *BotConfiguration) {
+			c.PearlRooms[0].BotPos = []float64{0, 64}
+		}, []string{"rooms[0].botPos"}},
+		{"server", func(c *BotConfiguration) {
+			c.PearlRooms[1].ServerAdress = "mc.example.com:99999"
+		}, []string{"rooms[1].serverAdress"}},
+		{"chamber out of reach", func(c *BotConfiguration) {
+			c.PearlRooms[1].Chambers[0].Pos = []float64{110, 70, 100}
+		}, []string{"rooms[1].chambers[0].pos"}},
+		{"shared credentials", func(c *BotConfiguration) {
+			c.PearlRooms[1].AccountCredentialsName = "main"
+		}, []string{"rooms[0].accountCredentialsName"}},
+		{"everything at once", func(c *BotConfiguration) {
+			c.GuildID = "guild"
+			c.Permissions.Everyone = []string{"fly"}
+			c.CredentialsStore = "s3"
+			room := &c.PearlRooms[0]
+			room.DiscordChannel = ""
+			room.BotPos = []float64{0, 64}
+			room.Chambers[0].Mechanism = "door"
+			room.Chambers[1].Index = 1
+			room.Chambers[1].Label = "5"
+			room.Chambers[1].Face = "side"
+			c.PearlRooms[1].Chambers[0].Pos = []float64{110, 70, 100}
+			c.PearlRooms[1].Chambers[0].Owner = "someone"
+		}, []string{
+			"permissions.everyone[0]",
+			"credentialsStore",
+			"guildID",
+			"rooms[0].discordChannel",
+			"rooms[0].botPos",
+			"rooms[0].chambers[0].mechanism",
+			"rooms[0].chambers[1].index",
+			"rooms[0].chambers[1].face",
+			"rooms[0].chambers[1].label",
+			"rooms[1].chambers[0].ownerDiscordId",
+			"rooms[1].chambers[0].pos",
+		}},
+	}
+	for _, tt := range tests {
+		conf := validVerifyConfig(t)
+		tt.edit(conf)
+		err := verifyConfig(conf)
+		var got []string
+		if err != nil {
+			var invalid *ErrorConfigInvalid
+			if !errors.As(err, &invalid) {
+				t.Errorf("%s: got %v, want ErrorConfigInvalid", tt.name, err)
+				continue
+			}
+			for _, p := range invalid.Problems {
+				got = append(got, p.Path)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got problems at %q, want %q\n%v", tt.name, got, tt.want, err)
+		}
+	}
+}
+
+func TestVerifyConfigUnsafeCredentialsName(t *testing.T) {
+	conf := &BotConfiguration{
+		AccountsCredentialCachePath: t.TempDir(),
+		PearlRooms: []PearlRoom{{
+			AccountCredentialsName: "../config.json",
+			DiscordChannel:         "123456789012345678",
+			ServerAdress:           "localhost",
+			BotPos:                 []float64{0, 64, 0},
+		}},
+	}
+	err := verifyConfig(conf)
+	var invalid *ErrorConfigInvalid
+	if !errors.As(err, &invalid) {
+		t.Fatalf("got %v, want ErrorConfigInvalid", err)
+	}
+	if len(invalid.Problems) != 1 || invalid.Problems[0].Path != "rooms[0].accountCredentialsName" {
+		t.Fatalf("got problems %v", err)
+	}
+	var unsafe *ErrorUnsafeCredentialsName
+	if !errors.As(invalid.Problems[0], &unsafe) {
+		t.Errorf("got %v, want ErrorUnsafeCredentialsName", invalid.Problems[0].Err)
+	}
+	conf.PearlRooms[0].AccountCredentialsName = "config"
+	if err := verifyConfig(conf); err != nil {
+		t.Errorf("safe name is rejected: %v", err)
+	}
+}
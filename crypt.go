@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// credentialsKeyEnvVar holds base64 encoded key, it takes precedence over key file
+const credentialsKeyEnvVar = "CredentialsKey"
+
+const credentialsKeySize = 32
+
+// encrypted cache file is header, nonce and AES-GCM sealed JSON
+var encryptedCacheHeader = []byte("PEARLBOT-AES256GCM-1\n")
+
+var (
+	// credentialsKey is nil if cache files are not encrypted, previous
+	// key is kept after rotation in case it was interrupted half way
+	credentialsKey     []byte
+	credentialsKeyPrev []byte
+	credentialsKeyLock sync.RWMutex
+)
+
+var ErrorNoCredentialsKey = errors.New("credentials cache is encrypted but no key is configured")
+
+func decodeCredentialsKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %w", err)
+	}
+	if len(key) != credentialsKeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", credentialsKeySize, len(key))
+	}
+	return key, nil
+}
+
+func readCredentialsKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeCredentialsKey(string(b))
+}
+
+// readCredentialsKey reads key from environment or key file, without
+// either of them cache files are stored as plain JSON
+func readCredentialsKey(conf *BotConfiguration) (key, prev []byte, err error) {
+	if env := os.Getenv(credentialsKeyEnvVar); env != "" {
+		key, err = decodeCredentialsKey(env)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", credentialsKeyEnvVar, err)
+		}
+	} else if conf.CredentialsKeyFile != "" {
+		key, err = readCredentialsKeyFile(conf.CredentialsKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("credentials key file: %w", err)
+		}
+		prev, err = readCredentialsKeyFile(conf.CredentialsKeyFile + ".old")
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("previous credentials key file: %w", err)
+		}
+	}
+	return key, prev, nil
+}
+
+func setCredentialsKey(key, prev []byte) {
+	credentialsKeyLock.Lock()
+	defer credentialsKeyLock.Unlock()
+	credentialsKey = key
+	credentialsKeyPrev = prev
+}
+
+// loadCredentialsKey reads key of config and starts using it
+func loadCredentialsKey(conf *BotConfiguration) error {
+	key, prev, err := readCredentialsKey(conf)
+	if err != nil {
+		return err
+	}
+	setCredentialsKey(key, prev)
+	return nil
+}
+
+func isEncryptedCache(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedCacheHeader)
+}
+
+func encryptCache(key, plain []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append([]byte{}, encryptedCacheHeader...), nonce...)
+	// header is authenticated too so it can not be swapped
+	return gcm.Seal(out, nonce, plain, encryptedCacheHeader), nil
+}
+
+func decryptCache(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(encryptedCacheHeader):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted cache is truncated")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], encryptedCacheHeader)
+}
+
+// sealCache encrypts cache file contents if key is configured
+func sealCache(plain []byte) ([]byte, error) {
+	credentialsKeyLock.RLock()
+	defer credentialsKeyLock.RUnlock()
+	if credentialsKey == nil {
+		return plain, nil
+	}
+	return encryptCache(credentialsKey, plain)
+}
+
+// openCache decrypts cache file contents, plain JSON is returned as is,
+// migrate tells that file should be written again to get encrypted
+// with the current key
+func openCache(data []byte) (plain []byte, migrate bool, err error) {
+	credentialsKeyLock.RLock()
+	defer credentialsKeyLock.RUnlock()
+	if !isEncryptedCache(data) {
+		return data, credentialsKey != nil, nil
+	}
+	if credentialsKey == nil {
+		return nil, false, ErrorNoCredentialsKey
+	}
+	plain, err = decryptCache(credentialsKey, data)
+	if err == nil {
+		return plain, false, nil
+	}
+	if credentialsKeyPrev != nil {
+		if plain, errPrev := decryptCache(credentialsKeyPrev, data); errPrev == nil {
+			return plain, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("failed to decrypt credentials cache, wrong key? %w", err)
+}
+
+// isCredentialsCache tells if store entry is a credentials cache, directory
+// store can have config or anything else next to them
+func isCredentialsCache(data []byte) bool {
+	if isEncryptedCache(data) {
+		return true
+	}
+	var cache AuthCache
+	return json.Unmarshal(data, &cache) == nil && cache.Microsoft.RefreshToken != ""
+}
+
+// migrateCredentialsCaches rewrites every cache in the store that is not
+// encrypted with the current key, including ones no room uses anymore
+func migrateCredentialsCaches() error {
+	var names []string
+	err := useCredentialsStore(func(store credentialsStore) (err error) {
+		names, err = store.List()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		unlock := accounts.lock(name)
+		var data []byte
+		err := useCredentialsStore(func(store credentialsStore) (err error) {
+			data, err = store.Load(name)
+			return err
+		})
+		if err == nil && isCredentialsCache(data) {
+			_, err = loadCredentialsCache(name)
+		}
+		unlock()
+		if err != nil && !errors.Is(err, ErrorCredentialsNotFound) {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func currentCredentialsKey() []byte {
+	credentialsKeyLock.RLock()
+	defer credentialsKeyLock.RUnlock()
+	return credentialsKey
+}
+
+// reencryptCredentials encrypts every cache with the current key and
+// retires previous key, nothing sealed with it is accepted afterwards.
+// oldKey is key that was in use before config changed it, it is accepted
+// until everything is encrypted again. Caller holds configEdit.
+func reencryptCredentials(conf *BotConfiguration, oldKey []byte) error {
+	credentialsKeyLock.Lock()
+	if credentialsKeyPrev == nil && oldKey != nil && !bytes.Equal(oldKey, credentialsKey) {
+		credentialsKeyPrev = oldKey
+	}
+	credentialsKeyLock.Unlock()
+	if err := migrateCredentialsCaches(); err != nil {
+		return err
+	}
+	if os.Getenv(credentialsKeyEnvVar) == "" && conf.CredentialsKeyFile != "" {
+		err := os.Remove(conf.CredentialsKeyFile + ".old")
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	credentialsKeyLock.Lock()
+	credentialsKeyPrev = nil
+	credentialsKeyLock.Unlock()
+	return nil
+}
+
+// rotateCredentialsKey generates new key, keeps current one as .old in
+// case rotation is interrupted, encrypts every cache file again and
+// removes the old key
+func rotateCredentialsKey() error {
+	if os.Getenv(credentialsKeyEnvVar) != "" {
+		return errors.New("key is set with " + credentialsKeyEnvVar + " environment variable, rotate it there and restart")
+	}
+	// a second rotation would replace .old while caches still need it
+	state.configEdit.Lock()
+	defer state.configEdit.Unlock()
+	conf := getConfig()
+	if conf.CredentialsKeyFile == "" {
+		return errors.New("credentials key file is not configured")
+	}
+	// make sure everything is readable before touching the key
+	if err := reencryptCredentials(conf, nil); err != nil {
+		return err
+	}
+	key := make([]byte, credentialsKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	path := conf.CredentialsKeyFile
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, path+".old"); err != nil {
+			return err
+		}
+	}
+	err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	if err := loadCredentialsKey(conf); err != nil {
+		return err
+	}
+	return reencryptCredentials(conf, nil)
+}
+
+func commandAuthRotateKey(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	started := time.Now()
+	err := rotateCredentialsKey()
+	e := auditEntry{Action: "auth rotate-key", User: interactionUserID(i), Result: "ok", Duration: time.Since(started)}
+	if err != nil {
+		e.Result = "failed"
+		e.Detail = err.Error()
+	}
+	writeAudit(s, e)
+	if err != nil {
+		log.Printf("Credentials key rotation failed: %v", err)
+		iTextResponse(s, i, "Failed to rotate key: "+err.Error())
+		return
+	}
+	iTextResponse(s, i, "Credentials key rotated, all credentials are encrypted with the new key")
+}
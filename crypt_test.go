@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	GMMAuth "github.com/maxsupermanhd/go-mc-ms-auth"
+)
+
+func TestMigrateCredentialsCachesUnreferenced(t *testing.T) {
+	dir := t.TempDir()
+	conf := &BotConfiguration{AccountsCredentialCachePath: dir}
+	if err := setupCredentialsStore(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeCredentialsStore)
+	setConfig(conf)
+	plain, _ := json.Marshal(map[string]interface{}{"microsoft": map[string]interface{}{"RefreshToken": "token"}, "username": "old"})
+	if err := os.WriteFile(filepath.Join(dir, "unused"), plain, 0600); err != nil {
+		t.Fatal(err)
+	}
+	other := []byte(`{"discordToken":"not a cache"}`)
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), other, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	credentialsKeyLock.Lock()
+	credentialsKey = make([]byte, credentialsKeySize)
+	credentialsKeyLock.Unlock()
+	t.Cleanup(func() {
+		credentialsKeyLock.Lock()
+		credentialsKey = nil
+		credentialsKeyLock.Unlock()
+	})
+
+	if err := migrateCredentialsCaches(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "unused"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncryptedCache(data) {
+		t.Errorf("credentials no room uses were not encrypted")
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(other) {
+		t.Errorf("file that is not credentials was rewritten: %s", data)
+	}
+}
+
+// setupKeyFile applies config with memory store and key file with a fresh key
+func setupKeyFile(t *testing.T) *BotConfiguration {
+	t.Helper()
+	prev := getConfig()
+	keyFile := filepath.Join(t.TempDir(), "credentials.key")
+	key := make([]byte, credentialsKeySize)
+	rand.Read(key)
+	if err := os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &BotConfiguration{CredentialsStore: credentialsStoreMemory, CredentialsKeyFile: keyFile}
+	if err := applyConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		closeCredentialsStore()
+		setCredentialsKey(nil, nil)
+		setConfig(prev)
+	})
+	return conf
+}
+
+func TestRotateCredentialsKeyRetiresOldKey(t *testing.T) {
+	conf := setupKeyFile(t)
+	for _, name := range []string{"a", "b", "c"} {
+		if err := writeCredentialsCache(name, AuthCache{Microsoft: GMMAuth.MSauth{RefreshToken: name}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldKey := currentCredentialsKey()
+	var sealedOld []byte
+	useCredentialsStore(func(store credentialsStore) (err error) {
+		sealedOld, err = store.Load("a")
+		return err
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = rotateCredentialsKey()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(conf.CredentialsKeyFile + ".old"); !os.IsNotExist(err) {
+		t.Errorf("old key file is still there: %v", err)
+	}
+	credentialsKeyLock.RLock()
+	prevKey := credentialsKeyPrev
+	credentialsKeyLock.RUnlock()
+	if prevKey != nil {
+		t.Error("previous key is still accepted")
+	}
+	if bytes.Equal(oldKey, currentCredentialsKey()) {
+		t.Fatal("key was not rotated")
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		cache, err := getCredentialsCache(name)
+		if err != nil || cache.Microsoft.RefreshToken != name {
+			t.Errorf("%s is not readable after rotations: %v", name, err)
+		}
+	}
+	if _, _, err := openCache(sealedOld); err == nil {
+		t.Error("cache sealed with retired key is accepted")
+	}
+}
+
+func TestGetCredentialsCacheDoesNotWrite(t *testing.T) {
+	setupKeyFile(t)
+	plain := []byte(`{"microsoft":{"RefreshToken":"token"}}`)
+	useCredentialsStore(func(store credentialsStore) error {
+		return store.Save("acc", plain)
+	})
+	cache, err := getCredentialsCache("acc")
+	if err != nil || cache.Microsoft.RefreshToken != "token" {
+		t.Fatalf("got %+v, %v", cache, err)
+	}
+	var data []byte
+	useCredentialsStore(func(store credentialsStore) (err error) {
+		data, err = store.Load("acc")
+		return err
+	})
+	if !bytes.Equal(data, plain) {
+		t.Error("reading credentials without account lock wrote them")
+	}
+	if _, err := loadCredentialsCache("acc"); err != nil {
+		t.Fatal(err)
+	}
+	useCredentialsStore(func(store credentialsStore) (err error) {
+		data, err = store.Load("acc")
+		return err
+	})
+	if !isEncryptedCache(data) {
+		t.Error("loading credentials did not encrypt them")
+	}
+}
+
+func TestLoadConfigReencryptsWithNewKey(t *testing.T) {
+	conf := setupKeyFile(t)
+	if err := writeCredentialsCache("acc", AuthCache{Microsoft: GMMAuth.MSauth{RefreshToken: "token"}}); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	newKeyFile := filepath.Join(dir, "new.key")
+	key := make([]byte, credentialsKeySize)
+	rand.Read(key)
+	if err := os.WriteFile(newKeyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	prevPath := configPath
+	configPath = filepath.Join(dir, "config.json")
+	t.Cleanup(func() { configPath = prevPath })
+	changed := *conf
+	changed.CredentialsKeyFile = newKeyFile
+	data, err := encodeConfig(configPath, &changed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(currentCredentialsKey(), key) {
+		t.Fatal("key of loaded config is not used")
+	}
+	var sealed []byte
+	useCredentialsStore(func(store credentialsStore) (err error) {
+		sealed, err = store.Load("acc")
+		return err
+	})
+	plain, err := decryptCache(key, sealed)
+	if err != nil {
+		t.Fatalf("credentials are not encrypted with new key: %v", err)
+	}
+	if !bytes.Contains(plain, []byte("token")) {
+		t.Errorf("credentials got lost: %s", plain)
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
-import "github.com/bwmarrin/discordgo"
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
 
 func iTextResponse(s *discordgo.Session, i *discordgo.InteractionCreate, resp string) error {
 	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
@@ -10,3 +16,128 @@ func iTextResponse(s *discordgo.Session, i *discordgo.InteractionCreate, resp st
 		},
 	})
 }
+
+const ephemeralFlag = 1 << 6
+
+// iEphemeralResponse responds with a message only interaction author can see
+func iEphemeralResponse(s *discordgo.Session, i *discordgo.InteractionCreate, resp string) error {
+	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: resp,
+			Flags:   ephemeralFlag,
+		},
+	})
+}
+
+// iQuietTextResponse responds without pinging anyone mentioned in resp
+func iQuietTextResponse(s *discordgo.Session, i *discordgo.InteractionCreate, resp string) error {
+	return s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: resp,
+			AllowedMentions: &discordgo.MessageAllowedMentions{
+				Parse: []discordgo.AllowedMentionType{},
+			},
+		},
+	})
+}
+
+// interaction tokens are valid for 15 minutes, status moves to a channel
+// message a bit before that
+const interactionEditLimit = 14 * time.Minute
+
+// statusMessage is a single Discord message that is edited as some long
+// operation progresses. It is backed either by an interaction response or
+// by a plain channel message when there is no interaction to answer or
+// its token expired. It is updated from several goroutines, updates are
+// sent one at a time in the order they were made.
+type statusMessage struct {
+	lock        sync.Mutex
+	s           *discordgo.Session
+	interaction *discordgo.Interaction
+	created     time.Time
+	channelID   string
+	messageID   string
+	sent        bool
+}
+
+func interactionStatus(s *discordgo.Session, i *discordgo.InteractionCreate) *statusMessage {
+	created, err := discordgo.SnowflakeTimestamp(i.ID)
+	if err != nil {
+		created = time.Now()
+	}
+	return &statusMessage{s: s, interaction: i.Interaction, created: created, channelID: i.ChannelID}
+}
+
+func channelStatus(s *discordgo.Session, channelID string) *statusMessage {
+	return &statusMessage{s: s, channelID: channelID}
+}
+
+// Update sends status message first time it is called and edits it afterwards.
+func (m *statusMessage) Update(content string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.interaction != nil {
+		if !m.sent {
+			m.sent = true
+			err := m.s.InteractionRespond(m.interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseChannelMessageWithSource,
+				Data: &discordgo.InteractionResponseData{
+					Content: content,
+				},
+			})
+			if err == nil {
+				return nil
+			}
+			log.Printf("Failed to respond to interaction, using channel message: %v", err)
+		} else if time.Since(m.created) < interactionEditLimit {
+			_, err := m.s.InteractionResponseEdit(m.s.State.User.ID, m.interaction, &discordgo.WebhookEdit{Content: content})
+			if err == nil {
+				return nil
+			}
+			log.Printf("Failed to edit interaction response, using channel message: %v", err)
+		}
+		m.interaction = nil
+		m.sent = false
+	}
+	if !m.sent {
+		msg, err := m.s.ChannelMessageSend(m.channelID, content)
+		if err != nil {
+			return err
+		}
+		m.sent = true
+		m.messageID = msg.ID
+		return nil
+	}
+	_, err := m.s.ChannelMessageEdit(m.channelID, m.messageID, content)
+	return err
+}
+
+// applicationCommandOptionNumber is a double option type that discordgo does not define yet
+const applicationCommandOptionNumber discordgo.ApplicationCommandOptionType = 10
+
+func optionsMap(options []*discordgo.ApplicationCommandInteractionDataOption) map[string]*discordgo.ApplicationCommandInteractionDataOption {
+	ret := map[string]*discordgo.ApplicationCommandInteractionDataOption{}
+	for _, o := range options {
+		ret[o.Name] = o
+	}
+	return ret
+}
+
+func optionString(options map[string]*discordgo.ApplicationCommandInteractionDataOption, name string) string {
+	if o, ok := options[name]; ok {
+		return o.StringValue()
+	}
+	return ""
+}
+
+func interactionUserID(i *discordgo.InteractionCreate) string {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User.ID
+	}
+	if i.User != nil {
+		return i.User.ID
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+type discordRequest struct {
+	method  string
+	path    string
+	content string
+}
+
+// fakeDiscord answers Discord API requests of a session, failing ones
+// with paths containing fail
+type fakeDiscord struct {
+	lock     sync.Mutex
+	requests []discordRequest
+	fail     string
+	// release is waited for before answering if set
+	release chan struct{}
+}
+
+func (f *fakeDiscord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Content string `json:"content"`
+		Data    struct {
+			Content string `json:"content"`
+		} `json:"data"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.lock.Lock()
+	f.requests = append(f.requests, discordRequest{r.Method, r.URL.Path, body.Content + body.Data.Content})
+	n := len(f.requests)
+	fail := f.fail != "" && strings.Contains(r.URL.Path, f.fail)
+	f.lock.Unlock()
+	if f.release != nil {
+		<-f.release
+	}
+	if fail {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"Unknown Webhook","code":10015}`))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"id":"%d","channel_id":"channel"}`, n)
+}
+
+func (f *fakeDiscord) Requests() []discordRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]discordRequest{}, f.requests...)
+}
+
+type redirectTransport struct {
+	to *url.URL
+}
+
+func (t redirectTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.URL.Scheme = t.to.Scheme
+	r.URL.Host = t.to.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func fakeDiscordSession(t *testing.T, f *fakeDiscord) *discordgo.Session {
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	to, _ := url.Parse(srv.URL)
+	s, _ := discordgo.New()
+	s.Client = &http.Client{Transport: redirectTransport{to}}
+	s.State.User = &discordgo.User{ID: "app"}
+	return s
+}
+
+func fakeInteraction(created time.Time) *discordgo.InteractionCreate {
+	id := (created.UnixNano()/int64(time.Millisecond) - 1420070400000) << 22
+	return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+		ID:        fmt.Sprint(id),
+		Token:     "token",
+		ChannelID: "channel",
+	}}
+}
+
+func TestStatusMessageConcurrentUpdates(t *testing.T) {
+	f := &fakeDiscord{}
+	m := interactionStatus(fakeDiscordSession(t, f), fakeInteraction(time.Now()))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := m.Update(fmt.Sprint("update ", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	m.Update("final")
+	requests := f.Requests()
+	responds := 0
+	for _, r := range requests {
+		if strings.HasSuffix(r.path, "/callback") {
+			responds++
+		} else if r.method != http.MethodPatch {
+			t.Errorf("unexpected %s %s", r.method, r.path)
+		}
+	}
+	if responds != 1 {
+		t.Errorf("interaction was responded %d times", responds)
+	}
+	if last := requests[len(requests)-1]; last.content != "final" {
+		t.Errorf("last update was %q", last.content)
+	}
+}
+
+func TestStatusMessageFallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		created time.Time
+		fail    string
+		want    []string
+	}{
+		{"fresh", time.Now(), "", []string{"POST /callback", "PATCH /@original", "PATCH /@original"}},
+		{"expired token", time.Now().Add(-interactionEditLimit - time.Minute), "",
+			[]string{"POST /callback", "POST /channels/channel/messages", "PATCH /channels/channel/messages/2"}},
+		{"edit fails", time.Now(), "@original",
+			[]string{"POST /callback", "PATCH /@original", "POST /channels/channel/messages", "PATCH /channels/channel/messages/3"}},
+		{"respond fails", time.Now(), "callback",
+			[]string{"POST /callback", "POST /channels/channel/messages", "PATCH /channels/channel/messages/2", "PATCH /channels/channel/messages/2"}},
+	}
+	for _, tt := range tests {
+		f := &fakeDiscord{fail: tt.fail}
+		m := interactionStatus(fakeDiscordSession(t, f), fakeInteraction(tt.created))
+		for _, content := range []string{"first", "second", "third"} {
+			if err := m.Update(content); err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+		}
+		got := []string{}
+		for _, r := range f.Requests() {
+			got = append(got, r.method+" "+r.path)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			w := strings.SplitN(tt.want[i], " ", 2)
+			if !strings.HasPrefix(got[i], w[0]+" ") || !strings.HasSuffix(got[i], w[1]) {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	pk "github.com/Tnze/go-mc/net/packet"
+)
+
+const (
+	playerEyeHeight = 1.62
+	// survival reach, from eyes to the point player clicks
+	playerReach = 4.5
+)
+
+// Chamber mechanisms, that is a block bot clicks to release the pearl
+const (
+	mechanismTrapdoor    = "trapdoor"
+	mechanismTrapdoorTop = "trapdoor-top"
+	mechanismButton      = "button"
+	mechanismLever       = "lever"
+	mechanismNoteBlock   = "noteblock"
+	mechanismFenceGate   = "fencegate"
+)
+
+// Attachment of buttons and levers and facing of buttons, levers and fence
+// gates, the same as block state properties shown on F3 screen
+const (
+	faceFloor   = "floor"
+	faceWall    = "wall"
+	faceCeiling = "ceiling"
+
+	facingNorth = "north"
+	facingSouth = "south"
+	facingWest  = "west"
+	facingEast  = "east"
+)
+
+var (
+	chamberFaces   = []string{faceFloor, faceWall, faceCeiling}
+	chamberFacings = []string{facingNorth, facingSouth, facingWest, facingEast}
+)
+
+// hitbox is outline of the block bot clicks, relative to block origin
+type hitbox struct {
+	min, max [3]float64
+}
+
+// box makes hitbox from coordinates in pixels (1/16 of a block) the same
+// way game code does
+func box(x0, y0, z0, x1, y1, z1 float64) hitbox {
+	return hitbox{[3]float64{x0 / 16, y0 / 16, z0 / 16}, [3]float64{x1 / 16, y1 / 16, z1 / 16}}
+}
+
+// mechanisms return hitbox of the mechanism attached by face and turned
+// to facing, closed trapdoors, unpressed buttons and closed gates
+var mechanisms = map[string]func(face, facing string) hitbox{
+	mechanismTrapdoor: func(_, _ string) hitbox {
+		return box(0, 0, 0, 16, 3, 16)
+	},
+	mechanismTrapdoorTop: func(_, _ string) hitbox {
+		return box(0, 13, 0, 16, 16, 16)
+	},
+	mechanismButton: func(face, facing string) hitbox {
+		xAxis := facing == facingWest || facing == facingEast
+		switch face {
+		case faceCeiling:
+			if xAxis {
+				return box(6, 14, 5, 10, 16, 11)
+			}
+			return box(5, 14, 6, 11, 16, 10)
+		case faceWall:
+			switch facing {
+			case facingSouth:
+				return box(5, 6, 0, 11, 10, 2)
+			case facingWest:
+				return box(14, 6, 5, 16, 10, 11)
+			case facingEast:
+				return box(0, 6, 5, 2, 10, 11)
+			}
+			return box(5, 6, 14, 11, 10, 16)
+		}
+		if xAxis {
+			return box(6, 0, 5, 10, 2, 11)
+		}
+		return box(5, 0, 6, 11, 2, 10)
+	},
+	mechanismLever: func(face, facing string) hitbox {
+		xAxis := facing == facingWest || facing == facingEast
+		switch face {
+		case faceCeiling:
+			if xAxis {
+				return box(4, 10, 5, 12, 16, 11)
+			}
+			return box(5, 10, 4, 11, 16, 12)
+		case faceWall:
+			switch facing {
+			case facingSouth:
+				return box(5, 4, 0, 11, 12, 6)
+			case facingWest:
+				return box(10, 4, 5, 16, 12, 11)
+			case facingEast:
+				return box(0, 4, 5, 6, 12, 11)
+			}
+			return box(5, 4, 10, 11, 12, 16)
+		}
+		if xAxis {
+			return box(4, 0, 5, 12, 6, 11)
+		}
+		return box(5, 0, 4, 11, 6, 12)
+	},
+	mechanismNoteBlock: func(_, _ string) hitbox {
+		return box(0, 0, 0, 16, 16, 16)
+	},
+	mechanismFenceGate: func(_, facing string) hitbox {
+		if facing == facingWest || facing == facingEast {
+			return box(6, 0, 0, 10, 16, 16)
+		}
+		return box(0, 0, 6, 16, 16, 10)
+	},
+}
+
+// mechanism returns chamber mechanism name, bottom trapdoor if not set
+func (c Chamber) mechanism() string {
+	if c.Mechanism == "" {
+		return mechanismTrapdoor
+	}
+	return c.Mechanism
+}
+
+// mechanismString is mechanism with its face and facing if they matter
+func (c Chamber) mechanismString() string {
+	ret := c.mechanism()
+	switch ret {
+	case mechanismButton, mechanismLever:
+		if c.Face != "" {
+			ret += " " + c.Face
+		}
+		fallthrough
+	case mechanismFenceGate:
+		if c.Facing != "" {
+			ret += " " + c.Facing
+		}
+	}
+	return ret
+}
+
+// hitbox returns outline of chamber mechanism, buttons and levers are on
+// the floor facing north unless set otherwise
+func (c Chamber) hitbox() hitbox {
+	face, facing := c.Face, c.Facing
+	if face == "" {
+		face = faceFloor
+	}
+	if facing == "" {
+		facing = facingNorth
+	}
+	return mechanisms[c.mechanism()](face, facing)
+}
+
+// Block faces as they are sent in use item packet
+const (
+	faceDown = iota
+	faceUp
+	faceNorth
+	faceSouth
+	faceWest
+	faceEast
+)
+
+type clickTarget struct {
+	face   int
+	cursor [3]float64 // relative to block origin
+	point  [3]float64 // absolute
+}
+
+func botEyePos(room PearlRoom) [3]float64 {
+	return [3]float64{room.BotPos[0], room.BotPos[1] + playerEyeHeight, room.BotPos[2]}
+}
+
+// computeClick finds face of the mechanism hitbox that is turned to the eye
+// the most and a point in the middle of it
+func computeClick(eye [3]float64, pos pk.Position, h hitbox) clickTarget {
+	origin := [3]float64{float64(pos.X), float64(pos.Y), float64(pos.Z)}
+	minBox, maxBox := [3]float64{}, [3]float64{}
+	for i := range origin {
+		minBox[i] = origin[i] + h.min[i]
+		maxBox[i] = origin[i] + h.max[i]
+	}
+	center := [3]float64{}
+	for i := range center {
+		center[i] = (minBox[i] + maxBox[i]) / 2
+	}
+	// how far eye is beyond each face plane, faces eye is behind are not visible
+	outside := [6]float64{
+		faceDown:  minBox[1] - eye[1],
+		faceUp:    eye[1] - maxBox[1],
+		faceNorth: minBox[2] - eye[2],
+		faceSouth: eye[2] - maxBox[2],
+		faceWest:  minBox[0] - eye[0],
+		faceEast:  eye[0] - maxBox[0],
+	}
+	face := faceUp
+	for f, d := range outside {
+		if d > outside[face] {
+			face = f
+		}
+	}
+	point := center
+	switch face {
+	case faceDown:
+		point[1] = minBox[1]
+	case faceUp:
+		point[1] = maxBox[1]
+	case faceNorth:
+		point[2] = minBox[2]
+	case faceSouth:
+		point[2] = maxBox[2]
+	case faceWest:
+		point[0] = minBox[0]
+	case faceEast:
+		point[0] = maxBox[0]
+	}
+	return clickTarget{
+		face:   face,
+		cursor: [3]float64{point[0] - float64(pos.X), point[1] - float64(pos.Y), point[2] - float64(pos.Z)},
+		point:  point,
+	}
+}
+
+type ErrorOutOfReach struct {
+	Chamber  int
+	Distance float64
+}
+
+func (e *ErrorOutOfReach) Error() string {
+	return fmt.Sprintf("chamber %d is %.2f blocks away from bot eyes, out of %.1f blocks reach", e.Chamber, e.Distance, playerReach)
+}
+
+// checkReach tells if bot standing at room bot position can click chamber cid
+func checkReach(room PearlRoom, cid int) error {
+	chamber := room.Chambers[cid]
+	eye := botEyePos(room)
+	click := computeClick(eye, chamberBlockPos(chamber), chamber.hitbox())
+	dx := click.point[0] - eye[0]
+	dy := click.point[1] - eye[1]
+	dz := click.point[2] - eye[2]
+	if d := math.Sqrt(dx*dx + dy*dy + dz*dz); d > playerReach {
+		return &ErrorOutOfReach{chamber.Index, d}
+	}
+	return nil
+}
+
+func getPitchYaw(x0, y0, z0, x, y, z float64) (pitch, yaw float64) {
+	dx := x - x0
+	dy := y - y0
+	dz := z - z0
+	r := math.Sqrt(dx*dx + dy*dy + dz*dz)
+	if r == 0 {
+		return 0, 0
+	}
+	yaw = -math.Atan2(dx, dz) / math.Pi * 180
+	if yaw < 0 {
+		yaw = 360 + yaw
+	}
+	pitch = -math.Asin(dy/r) / math.Pi * 180
+	return
+}
@@ -3,11 +3,13 @@ module github.com/maxsupermanhd/PearlBot
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/Tnze/go-mc v1.17.2-0.20220122135609-fee2e0c939a3
 	github.com/bwmarrin/discordgo v0.23.3-0.20220202194601-aba5dc811da8
-	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/maxsupermanhd/go-mc-ms-auth v0.0.0-20220116000032-2f2cb566788f
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.0.0-20220131195533-30dcbda58838 // indirect
 	golang.org/x/sys v0.0.0-20220128215802-99c3d69c2c27 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -15,7 +19,6 @@ import (
 	"github.com/Tnze/go-mc/data/packetid"
 	pk "github.com/Tnze/go-mc/net/packet"
 	"github.com/bwmarrin/discordgo"
-	GMMAuth "github.com/maxsupermanhd/go-mc-ms-auth"
 )
 
 var (
@@ -38,6 +41,24 @@ var (
 					Name:        "load",
 					Description: "Load config",
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "history",
+					Description: "List saved config versions",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "rollback",
+					Description: "Restore saved config version",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "version",
+							Description: "Version from config history",
+							Required:    true,
+						},
+					},
+				},
 			},
 		},
 		{
@@ -79,6 +100,11 @@ var (
 						},
 					},
 				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "rotate-key",
+					Description: "Encrypt all credentials with a new key",
+				},
 			},
 		},
 		{
@@ -86,9 +112,9 @@ var (
 			Description: "Activate stasis",
 			Options: []*discordgo.ApplicationCommandOption{
 				{
-					Type:        discordgo.ApplicationCommandOptionInteger,
+					Type:        discordgo.ApplicationCommandOptionString,
 					Name:        "chamber",
-					Description: "Selected stasis",
+					Description: "Selected stasis, index or label (-1 for all)",
 					Required:    true,
 				},
 				{
@@ -99,14 +125,160 @@ var (
 				},
 			},
 		},
-		// {
-		// 	Name:        "status",
-		// 	Description: "Spew out facts",
-		// },
-		// {
-		// 	Name:        "bots",
-		// 	Description: "Check out bots that are online",
-		// },
+		{
+			Name:        "room",
+			Description: "Manage rooms of this channel",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "create",
+					Description: "Create new room in this channel",
+					Options: append([]*discordgo.ApplicationCommandOption{
+						stringOption("name", "Room name"),
+						stringOption("credentials", "Account credentials name"),
+						stringOption("server", "Server address"),
+					}, coordinateOptions("bot position")...),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "delete",
+					Description: "Delete room",
+					Options:     []*discordgo.ApplicationCommandOption{roomOption()},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "rename",
+					Description: "Rename room",
+					Options:     []*discordgo.ApplicationCommandOption{stringOption("name", "New room name"), roomOption()},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set-server",
+					Description: "Change server address",
+					Options:     []*discordgo.ApplicationCommandOption{stringOption("server", "Server address"), roomOption()},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set-botpos",
+					Description: "Change position bot stands at",
+					Options:     append(coordinateOptions("bot position"), roomOption()),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set-account",
+					Description: "Change account credentials name",
+					Options:     []*discordgo.ApplicationCommandOption{stringOption("credentials", "Account credentials name"), roomOption()},
+				},
+			},
+		},
+		{
+			Name:        "chamber",
+			Description: "Manage chambers of a room",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "add",
+					Description: "Add chamber",
+					Options: append(append([]*discordgo.ApplicationCommandOption{chamberIndexOption()}, coordinateOptions("chamber")...),
+						mechanismOption(), faceOption(), facingOption(), labelOption(false), userOption("owner", "Chamber owner, you if not set", false), roomOption()),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "remove",
+					Description: "Remove chamber",
+					Options:     []*discordgo.ApplicationCommandOption{chamberIndexOption(), roomOption()},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "move",
+					Description: "Change chamber position",
+					Options:     append(append([]*discordgo.ApplicationCommandOption{chamberIndexOption()}, coordinateOptions("chamber")...), mechanismOption(), faceOption(), facingOption(), roomOption()),
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "label",
+					Description: "Change chamber label",
+					Options:     []*discordgo.ApplicationCommandOption{chamberIndexOption(), labelOption(true), roomOption()},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "allow",
+					Description: "Allow user to activate chamber",
+					Options:     []*discordgo.ApplicationCommandOption{chamberIndexOption(), userOption("user", "User to allow", true), roomOption()},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "deny",
+					Description: "Take back permission to activate chamber",
+					Options:     []*discordgo.ApplicationCommandOption{chamberIndexOption(), userOption("user", "User to deny", true), roomOption()},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List chambers",
+					Options:     []*discordgo.ApplicationCommandOption{roomOption()},
+				},
+			},
+		},
+		{
+			Name:        "audit",
+			Description: "Show audit log",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "room",
+					Description: "Only entries of room",
+					Required:    false,
+				},
+				userOption("user", "Only entries of user", false),
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "since",
+					Description: "Duration back from now (24h), date (2006-01-02) or RFC3339 time",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "until",
+					Description: "Duration back from now (24h), date (2006-01-02) or RFC3339 time",
+					Required:    false,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "limit",
+					Description: "How many entries to show, 20 by default",
+					Required:    false,
+				},
+			},
+		},
+		{
+			Name:        "status",
+			Description: "Check health of Xbox Live and Minecraft services",
+		},
+		{
+			Name:        "bots",
+			Description: "Check out bots that are online",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List running Minecraft clients",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disconnect",
+					Description: "Force disconnect a bot",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "id",
+							Description: "Bot ID from /bots list",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
 	}
 	commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
 		"help":     commandHelp,
@@ -114,11 +286,23 @@ var (
 		"rooms":    commandRooms,
 		"auth":     commandAuth,
 		"activate": commandActivate,
-		// "status":   commandStatus,
-		// "bots":     commandBots,
+		"room":     commandRoom,
+		"chamber":  commandChamber,
+		"audit":    commandAudit,
+		"status":   commandStatus,
+		"bots":     commandBots,
+	}
+	componentHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate){
+		"activateall": componentActivateAll,
 	}
-	// botsOnline = []bot.Client{}
-	dangerousActivations = map[string]activationRequest{}
+)
+
+const (
+	// hashed seed of the 2b2t queue world, bot never activates anything there
+	queueServerHashedSeed int64 = -4189754411863869379
+
+	dangerousActivationPhrase  = "Yes I am sure, do as I say!"
+	dangerousActivationTimeout = 15 * time.Second
 )
 
 type activationRequest struct {
@@ -128,29 +312,23 @@ type activationRequest struct {
 }
 
 func main() {
+	flag.StringVar(&configPath, "config", configPath, "config file, format is chosen by extension (.json, .yaml, .yml, .toml)")
+	flag.StringVar(&credentialsDirectory, "credentials", "", "credentials directory, overrides accountsCredentialsCachePath")
+	flag.Parse()
 	log.Println("Loading config...")
 	err := loadConfig()
 	if err != nil {
-		log.Fatalf("Error reading config: %s", err.Error())
+		log.Fatalf("Error loading config: %s", err.Error())
 	}
-	if config == nil {
-		log.Fatal("No errors but no config was made")
+	defer closeCredentialsStore()
+	stopExpiry := make(chan struct{})
+	defer close(stopExpiry)
+	go state.expireLoop(stopExpiry)
+	if getConfig().Permissions == nil {
+		log.Print("No permissions configured, everyone can use every command!")
 	}
-	log.Print("Verifying config...")
-	err = verifyConfig()
-	if err != nil {
-		log.Fatalf("Error verifying config: %s", err.Error())
-	}
-	go func() {
-		for k, v := range dangerousActivations {
-			if time.Until(v.when) < -120*time.Second {
-				delete(dangerousActivations, k)
-			}
-		}
-		time.Sleep(120 * time.Second)
-	}()
 	log.Print("Connecting to Discord...")
-	dg, err := discordgo.New("Bot " + config.DiscordToken)
+	dg, err := discordgo.New("Bot " + getConfig().DiscordToken)
 	if err != nil {
 		log.Println("error creating Discord session,", err)
 		return
@@ -168,17 +346,31 @@ func main() {
 	defer dg.Close()
 	log.Print("Registering commands...")
 	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
-		if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
-			h(s, i)
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+			if h, ok := commandHandlers[i.ApplicationCommandData().Name]; ok {
+				if checkCommandPermission(s, i) {
+					h(s, i)
+				}
+			}
+		case discordgo.InteractionMessageComponent:
+			handler := strings.SplitN(i.MessageComponentData().CustomID, ":", 2)[0]
+			if h, ok := componentHandlers[handler]; ok {
+				h(s, i)
+			}
 		}
 	})
 	for _, v := range commands {
 		log.Printf("Registering command [%s]...", v.Name)
-		_, err := dg.ApplicationCommandCreate(dg.State.User.ID, config.GuildID, v)
+		_, err := dg.ApplicationCommandCreate(dg.State.User.ID, getConfig().GuildID, v)
 		if err != nil {
 			log.Panicf("Cannot create '%v' command: %v", v.Name, err)
 		}
 	}
+	startTokenRefresher(dg)
+	defer stopTokenRefresher()
+	startRoomSessions(dg)
+	defer stopRoomSessions()
 	log.Println("Bot is now running. Send SIGINT or SIGTERM to exit.")
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
@@ -189,14 +381,19 @@ func main() {
 func commandHelp(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	iTextResponse(s, i, `**PearlBot usage**
 /help - shows this message
-/config (save|load) - config manipulation
+/config (save|load|history|rollback) - config manipulation
 /check - show diagnostic information
 /rooms - list all registered rooms in the channel
-/activate - activate pearl stasis chamber`)
+/room (create|delete|rename|set-server|set-botpos|set-account) - manage rooms
+/chamber (add|remove|move|label|allow|deny|list) - manage chambers of a room
+/activate - activate pearl stasis chamber by index or label
+/bots (list|disconnect) - show running Minecraft clients or force disconnect one
+/status - check health of Xbox Live and Minecraft services
+/audit - show audit log of activations, credential and config changes`)
 }
 
 func findRoomsByChannelID(channelID string) (ret []PearlRoom) {
-	for _, r := range config.PearlRooms {
+	for _, r := range getConfig().PearlRooms {
 		if r.DiscordChannel == channelID {
 			ret = append(ret, r)
 		}
@@ -241,86 +438,113 @@ func commandRooms(s *discordgo.Session, i *discordgo.InteractionCreate) {
 	})
 }
 
+func findRoomByName(channelID, roomname string) (PearlRoom, bool) {
+	for _, r := range findRoomsByChannelID(channelID) {
+		if r.RoomName == roomname {
+			return r, true
+		}
+	}
+	return PearlRoom{}, false
+}
+
 func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	// if m.Content != "Yes I am sure, do as I say!" {
-	// 	return
-	// }
-	// if t, ok := dangerousActivations[m.ChannelID]; ok {
-	// 	if t.byUser == m.Author.ID {
-	// 		if time.Until(t.when) < -15*time.Second {
-	// 			s.ChannelMessageSend(m.ChannelID, "You did not confirmed activation fast enough.")
-	// 			delete(dangerousActivations, m.ChannelID)
-	// 			return
-	// 		} else {
-	// 			rooms := findRoomsByChannelID(m.ChannelID)
-	// 			roomfound := false
-	// 			var room PearlRoom
-	// 			for _, r := range rooms {
-	// 				if r.RoomName == t.roomname {
-	// 					room = r
-	// 					roomfound = true
-	// 				}
-	// 			}
-	// 			if !roomfound {
-	// 				s.ChannelMessageSend(m.ChannelID, "Room not found?!")
-	// 				delete(dangerousActivations, m.ChannelID)
-	// 				return
-	// 			}
-
-	// 			// activateRoom(s, i, room, -1)
-	// 		}
-	// 	} else {
-	// 		return
-	// 	}
-	// }
+	if m.Author == nil || m.Author.ID == s.State.User.ID {
+		return
+	}
+	if m.Content != dangerousActivationPhrase {
+		return
+	}
+	t, ok := state.takePending(m.ChannelID, m.Author.ID)
+	if !ok || t.byUser != m.Author.ID {
+		return
+	}
+	if t.expired() {
+		s.ChannelMessageSend(m.ChannelID, "You did not confirm activation fast enough.")
+		return
+	}
+	room, ok := findRoomByName(m.ChannelID, t.roomname)
+	if !ok {
+		s.ChannelMessageSend(m.ChannelID, "Room `"+t.roomname+"` not found?!")
+		return
+	}
+	activateRoom(s, channelStatus(s, m.ChannelID), room, -1, t.byUser)
+}
+
+func componentActivateAll(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	action := strings.TrimPrefix(i.MessageComponentData().CustomID, "activateall:")
+	t, ok := state.takePending(i.ChannelID, interactionUserID(i))
+	if !ok {
+		iTextResponse(s, i, "There is no activation awaiting confirmation.")
+		return
+	}
+	if t.byUser != interactionUserID(i) {
+		iTextResponse(s, i, "Only <@"+t.byUser+"> can confirm or cancel this activation.")
+		return
+	}
+	expired := t.expired()
+	resp := ""
+	switch {
+	case expired:
+		resp = "You did not confirm activation fast enough."
+	case action == "cancel":
+		resp = "Activation of all chambers cancelled."
+	case action == "confirm":
+		resp = "Activation of all chambers confirmed."
+	default:
+		resp = "Unknown action `" + action + "`"
+	}
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    resp,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		log.Print(err)
+	}
+	if action != "confirm" || expired {
+		return
+	}
+	room, ok := findRoomByName(i.ChannelID, t.roomname)
+	if !ok {
+		s.ChannelMessageSend(i.ChannelID, "Room `"+t.roomname+"` not found?!")
+		return
+	}
+	activateRoom(s, channelStatus(s, i.ChannelID), room, -1, t.byUser)
 }
 
 func commandActivate(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	rooms := findRoomsByChannelID(i.ChannelID)
-	chambernum := int(i.ApplicationCommandData().Options[0].IntValue())
-	var room PearlRoom
-	if len(rooms) <= 0 {
-		iTextResponse(s, i, "Channel does not have any rooms attached")
+	opts := optionsMap(i.ApplicationCommandData().Options)
+	conf := getConfig()
+	roomindex, err := findRoomIndex(conf, i.ChannelID, optionString(opts, "room"))
+	if err != nil {
+		iTextResponse(s, i, err.Error())
 		return
 	}
-	if len(rooms) == 1 {
-		room = rooms[0]
-	} else {
-		if len(i.ApplicationCommandData().Options) < 2 {
-			iTextResponse(s, i, "Channel have more than one room attached, please specify room name")
-			return
-		}
-		roomname := i.ApplicationCommandData().Options[1].StringValue()
-		roomfound := false
-		for _, r := range rooms {
-			if r.RoomName == roomname {
-				room = r
-				roomfound = true
+	room := conf.PearlRooms[roomindex]
+	chambername := optionString(opts, "chamber")
+	userID := interactionUserID(i)
+	chamberindex := -1
+	if chambername == "-1" {
+		for c := range room.Chambers {
+			if !room.mayActivate(c, userID) {
+				iTextResponse(s, i, "You are not allowed to activate chamber "+room.Chambers[c].name()+", so you can not activate all of them")
+				return
 			}
 		}
-		if !roomfound {
-			iTextResponse(s, i, "Room `"+roomname+"` not found")
-			return
-		}
-	}
-	chamberfound := false
-	chamberindex := 0
-	if chambernum == -1 {
-		chamberfound = true
-		chamberindex = -1
-		if t, ok := dangerousActivations[i.ChannelID]; ok {
-			if t.byUser == i.Member.User.ID {
+		if t, ok := state.requestPending(i.ChannelID, activationRequest{
+			when:     time.Now(),
+			byUser:   userID,
+			roomname: room.RoomName,
+		}); !ok {
+			if t.byUser == userID {
 				iTextResponse(s, i, "Activation confirmation awaiting")
 			} else {
 				iTextResponse(s, i, "Other member already requested activation of everything, wait until he confirms it.")
 			}
 			return
 		} else {
-			dangerousActivations[i.ChannelID] = activationRequest{
-				when:     time.Now(),
-				byUser:   i.Member.User.ID,
-				roomname: room.RoomName,
-			}
 			err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 				Type: discordgo.InteractionResponseChannelMessageWithSource,
 				Data: &discordgo.InteractionResponseData{
@@ -328,10 +552,26 @@ func commandActivate(s *discordgo.Session, i *discordgo.InteractionCreate) {
 					Embeds: []*discordgo.MessageEmbed{
 						{
 							Title:       "Warning!",
-							Description: "This action will activate **all** chambers in the room!\nRespond with `Yes I am sure, do as I say!` in this channel within 15 seconds to confirm",
+							Description: fmt.Sprintf("This action will activate **all** chambers in the room!\nRespond with `%s` in this channel or press the button within %s to confirm", dangerousActivationPhrase, dangerousActivationTimeout.String()),
 							Color:       0xef2929,
 						},
 					},
+					Components: []discordgo.MessageComponent{
+						discordgo.ActionsRow{
+							Components: []discordgo.MessageComponent{
+								discordgo.Button{
+									Label:    "Activate everything",
+									Style:    discordgo.DangerButton,
+									CustomID: "activateall:confirm",
+								},
+								discordgo.Button{
+									Label:    "Cancel",
+									Style:    discordgo.SecondaryButton,
+									CustomID: "activateall:cancel",
+								},
+							},
+						},
+					},
 				},
 			})
 			if err != nil {
@@ -340,138 +580,128 @@ func commandActivate(s *discordgo.Session, i *discordgo.InteractionCreate) {
 			return
 		}
 	} else {
-		for index, c := range room.Chambers {
-			if c.Index == chambernum {
-				chamberfound = true
-				chamberindex = index
-				break
-			}
+		chamberindex = findChamber(room, chambername)
+		if chamberindex == -1 {
+			iTextResponse(s, i, fmt.Sprintf("Chamber %s in room %s not found", chambername, room.RoomName))
+			return
 		}
-		if !chamberfound {
-			iTextResponse(s, i, fmt.Sprintf("Chamber %d in room %s not found", chambernum, room.RoomName))
+		if !room.mayActivate(chamberindex, userID) {
+			iTextResponse(s, i, "Chamber "+room.Chambers[chamberindex].name()+" belongs to someone else, you are not allowed to activate it")
 			return
 		}
 	}
-	activateRoom(s, i, room, chamberindex)
+	activateRoom(s, interactionStatus(s, i), room, chamberindex, userID)
 }
 
-func activateRoom(s *discordgo.Session, i *discordgo.InteractionCreate, room PearlRoom, cid int) {
-	iTextResponse(s, i, fmt.Sprintf("Activating chamber %d in room %s...", cid, room.RoomName))
-	cache, err := getCredentialsCache(room.AccountCredentialsName)
-	if err != nil {
-		iTextResponse(s, i, "Failed to load credentials: "+err.Error())
-		return
+func activateRoom(s *discordgo.Session, status *statusMessage, room PearlRoom, cid int, userID string) {
+	started := time.Now()
+	chamber := "all"
+	if cid != -1 {
+		chamber = room.Chambers[cid].name()
 	}
-	if isDateExpired(cache.Minecraft.ExpiresAfter) {
-		iTextResponse(s, i, "Minecraft token expired, refreshing everything...")
-		err := GMMAuth.CheckRefreshMS(&cache.Microsoft, config.MicrosoftCID)
-		if err != nil {
-			iTextResponse(s, i, "Failed to refresh Microsoft credentials: "+err.Error())
-			return
-		}
-		XBLt, err := GMMAuth.AuthXBL(cache.Microsoft.AccessToken)
-		if err != nil {
-			iTextResponse(s, i, "Failed to refresh credentials, unable to get XBL token: "+err.Error())
-			return
-		}
-		XSTSt, err := GMMAuth.AuthXSTS(XBLt)
-		if err != nil {
-			iTextResponse(s, i, "Failed to refresh credentials, unable to get XSTS token: "+err.Error())
-			return
-		}
-		cache.Minecraft, err = GMMAuth.AuthMC(XSTSt)
-		if err != nil {
-			iTextResponse(s, i, "Failed to refresh credentials, unable to get MC token: "+err.Error())
-			return
+	audit := func(r activationResult) {
+		writeAudit(s, auditEntry{
+			Action:   "activate",
+			User:     userID,
+			Room:     room.RoomName,
+			Chamber:  chamber,
+			Result:   r.Outcome.name(),
+			Detail:   r.Detail,
+			Duration: time.Since(started),
+		})
+	}
+	for c := range room.Chambers {
+		if cid != -1 && cid != c {
+			continue
 		}
-		profile, err := GMMAuth.GetMCprofile(cache.Minecraft.Token)
-		if err != nil {
-			iTextResponse(s, i, "Unable to get MC profile: "+err.Error())
+		if err := checkReach(room, c); err != nil {
+			status.Update("Refusing to activate: " + err.Error() + ", move bot position closer")
+			audit(activationResult{activationSkipped, err.Error()})
 			return
 		}
-		cache.Username = profile.Name
-		cache.UUID = profile.UUID
-		err = writeCredentialsCache(room.AccountCredentialsName, cache)
-		if err != nil {
-			iTextResponse(s, i, "Unable to write credentials cache: "+err.Error())
+	}
+	// result of activation this one was merged into goes after the queued message
+	attached := make(chan struct{})
+	ticket, ahead, merged := activations.enter(room.AccountCredentialsName, room.chamberIndex(cid), func(r activationResult) {
+		<-attached
+		status.Update(r.String())
+		audit(activationResult{r.Outcome, "merged with activation already queued: " + r.Detail})
+	})
+	if merged {
+		status.Update(fmt.Sprintf("Activation of %s in room %s is already queued, it will happen only once and its result will be shown here", room.chamberString(cid), room.RoomName))
+		close(attached)
+		return
+	}
+	close(attached)
+	if room.StayLoggedIn {
+		if rs := getRoomSession(room.AccountCredentialsName); rs != nil {
+			// session activates one by one itself, ticket is only held to merge and count
+			rs.requestActivation(status, room, cid, ahead, func(r activationResult) {
+				ticket.leave(r)
+				audit(r)
+			})
 			return
 		}
 	}
-	triggerChamber(s, room, cid, bot.Auth{Name: cache.Username, UUID: cache.UUID, AsTk: cache.Minecraft.Token})
+	r := waitAndActivate(s, status, room, cid, ticket, ahead)
+	ticket.leave(r)
+	audit(r)
 }
 
-func getPitchYaw(x0, y0, z0, x, y, z float64) (pitch, yaw float64) {
-	dx := x - x0
-	dy := y - y0
-	dz := z - z0
-	r := math.Sqrt(dx*dx + dy*dy + dz*dz)
-	yaw = -math.Atan2(dx, dz) / math.Pi * 180
-	if yaw < 0 {
-		yaw = 360 + yaw
+// waitAndActivate waits for turn of the ticket and activates chamber cid
+// logging in just for that
+func waitAndActivate(s *discordgo.Session, status *statusMessage, room PearlRoom, cid int, ticket *activationTicket, ahead int) activationResult {
+	if ahead > 0 {
+		status.Update(queuedBehindString(ahead))
+		timeout := time.After(room.activationTimeout())
+		for waiting := true; waiting; {
+			select {
+			case <-ticket.ready:
+				waiting = false
+			case ahead := <-ticket.moves:
+				status.Update(queuedBehindString(ahead))
+			case <-timeout:
+				r := activationResult{activationTimedOut, "account was busy with other activations"}
+				status.Update(r.String())
+				return r
+			}
+		}
 	}
-	pitch = -math.Asin(dy/r) / math.Pi * 180
-	return
+	status.Update(fmt.Sprintf("Activating %s in room %s...", room.chamberString(cid), room.RoomName))
+	auth, err := accounts.Auth(room.AccountCredentialsName, func(stage authStage) {
+		status.Update("Refreshing credentials: " + stage.String() + "...")
+	})
+	if err != nil {
+		status.Update(err.Error())
+		return activationResult{activationFailed, err.Error()}
+	}
+	return triggerChamber(s, status, room, cid, auth)
 }
 
 func sendActivation(mcClient bot.Client, room PearlRoom, cid int) {
-	blockCastPos := []float64{0.0, room.Chambers[cid].Pos[1] + 0.5, 0.0}
-	if room.BotPos[0] < room.Chambers[cid].Pos[0] {
-		blockCastPos[0] = room.Chambers[cid].Pos[0] - 0.5
-	} else {
-		blockCastPos[0] = room.Chambers[cid].Pos[0] + 0.5
-	}
-	if room.BotPos[2] < room.Chambers[cid].Pos[2] {
-		blockCastPos[2] = room.Chambers[cid].Pos[2] + 0.5
-	} else {
-		blockCastPos[2] = room.Chambers[cid].Pos[2] - 0.5
-	}
-	_, yaw := getPitchYaw(room.BotPos[0], room.BotPos[1], room.BotPos[2],
-		blockCastPos[0], blockCastPos[1], blockCastPos[2])
+	chamber := room.Chambers[cid]
+	pos := chamberBlockPos(chamber)
+	eye := botEyePos(room)
+	click := computeClick(eye, pos, chamber.hitbox())
+	pitch, yaw := getPitchYaw(eye[0], eye[1], eye[2], click.point[0], click.point[1], click.point[2])
 	mcClient.Conn.WritePacket(pk.Marshal(
 		packetid.ServerboundMovePlayerRot,
 		pk.Float(yaw),
-		pk.Float(19.2),
+		pk.Float(pitch),
 		pk.Boolean(true),
 	))
-	cursorX := 0.0
-	cursorZ := 0.0
-	blockFace := 0
-	if yaw > 315 || yaw < 45 {
-		// facing south
-		cursorX = 0.5
-		cursorZ = 0.875
-		blockFace = 2
-	}
-	if yaw > 45 && yaw < 135 {
-		// facing west
-		cursorX = 0.125
-		cursorZ = 0.5
-		blockFace = 5
-	}
-	if yaw > 135 && yaw < 225 {
-		// facing north
-		cursorX = 0.5
-		cursorZ = 0.125
-		blockFace = 3
-	}
-	if yaw > 225 && yaw < 315 {
-		// facing east
-		cursorX = 0.875
-		cursorZ = 0.5
-		blockFace = 4
-	}
 	time.Sleep(100 * time.Millisecond)
-	log.Printf("yaw %.0f cursor %.2f %.2f block %.1f %.1f %.1f", yaw, cursorX, cursorZ, blockCastPos[0], blockCastPos[1], blockCastPos[2])
-	log.Print(pk.Position{X: int(room.Chambers[cid].Pos[0]), Y: int(room.Chambers[cid].Pos[1]), Z: int(room.Chambers[cid].Pos[2])})
+	log.Printf("%s at %v: yaw %.1f pitch %.1f face %d cursor %.3f %.3f %.3f", chamber.mechanism(), pos, yaw, pitch,
+		click.face, click.cursor[0], click.cursor[1], click.cursor[2])
 	mcClient.Conn.WritePacket(pk.Marshal(
 		packetid.ServerboundUseItemOn,
-		pk.VarInt(0), //hand
-		pk.Position(pk.Position{X: int(room.Chambers[cid].Pos[0]), Y: int(room.Chambers[cid].Pos[1]), Z: int(room.Chambers[cid].Pos[2])}), //((int64(x)&0x3FFFFFF)<<38)|((int64(z)&0x3FFFFFF)<<12)|(int64(y)&0xFFF)), //position
-		pk.VarInt(blockFace), //direction
-		pk.Float(cursorX),    //cursor x
-		pk.Float(0.125),      //y
-		pk.Float(cursorZ),    //z
-		pk.Boolean(true),     //inside
+		pk.VarInt(0),              //hand
+		pos,                       //position
+		pk.VarInt(click.face),     //direction
+		pk.Float(click.cursor[0]), //cursor x
+		pk.Float(click.cursor[1]), //y
+		pk.Float(click.cursor[2]), //z
+		pk.Boolean(false),         //inside
 	))
 	mcClient.Conn.WritePacket(pk.Marshal(
 		packetid.ServerboundSwing,
@@ -479,59 +709,278 @@ func sendActivation(mcClient bot.Client, room PearlRoom, cid int) {
 	))
 }
 
-func triggerChamber(s *discordgo.Session, room PearlRoom, cid int, auth bot.Auth) {
+const (
+	blockChangeTimeout = 2 * time.Second
+	pearlGoneTimeout   = 3 * time.Second
+)
+
+type ErrorActivationUnverified struct {
+	Chamber  int
+	Attempts int
+	State    int
+}
+
+func (e *ErrorActivationUnverified) Error() string {
+	return fmt.Sprintf("chamber %d did not change state after %d attempts, block is %s", e.Chamber, e.Attempts, blockStateString(e.State))
+}
+
+type ErrorChamberNotLoaded struct {
+	Chamber int
+}
+
+func (e *ErrorChamberNotLoaded) Error() string {
+	return fmt.Sprintf("chunk of chamber %d is not loaded, it was not clicked", e.Chamber)
+}
+
+// activator clicks chambers of the room and watches the world
+// around them to tell whether that actually did something
+type activator struct {
+	client *bot.Client
+	room   PearlRoom
+	blocks *blockTracker
+	pearls *pearlTracker
+}
+
+func newActivator(mcClient *bot.Client, room PearlRoom) *activator {
+	a := &activator{
+		client: mcClient,
+		room:   room,
+		blocks: newRoomBlockTracker(room),
+		pearls: newPearlTracker(),
+	}
+	a.blocks.Attach(mcClient)
+	a.pearls.Attach(mcClient)
+	return a
+}
+
+// setRoom replaces room settings, chambers that were added or moved
+// are watched from now on
+func (a *activator) setRoom(room PearlRoom) {
+	a.room = room
+	for _, c := range room.Chambers {
+		a.blocks.Watch(chamberBlockPos(c))
+	}
+}
+
+// emptyWarning tells which of selected chambers have no pearl seen near them
+func (a *activator) emptyWarning(cid int) string {
+	empty := []string{}
+	for c, chamber := range a.room.Chambers {
+		if (cid == -1 || cid == c) && a.pearls.Near(chamberBlockPos(chamber)) == 0 {
+			empty = append(empty, strconv.Itoa(chamber.Index))
+		}
+	}
+	if len(empty) == 0 {
+		return ""
+	}
+	return ":warning: No pearl seen in chamber " + strings.Join(empty, ", ") + ", it looks empty"
+}
+
+// activateChamber clicks chamber until server reports that its block
+// changed state or room retries run out, then checks if pearl is gone
+func (a *activator) activateChamber(cid int) (string, error) {
+	chamber := a.room.Chambers[cid]
+	if err := checkReach(a.room, cid); err != nil {
+		return "", err
+	}
+	pos := chamberBlockPos(chamber)
+	pearls := a.pearls.Near(pos)
+	before := a.blocks.State(pos)
+	if before == blockUnknown {
+		before, _ = a.blocks.WaitChange(pos, blockUnknown, blockChangeTimeout)
+	}
+	// chunk arriving later would look like the click worked
+	if before == blockUnknown {
+		return "", &ErrorChamberNotLoaded{chamber.Index}
+	}
+	changes := a.blocks.Changes(pos)
+	sendActivation(*a.client, a.room, cid)
+	_, flipped := a.blocks.WaitChange(pos, before, blockChangeTimeout)
+	for attempt := 1; attempt <= a.room.ActivationRetries && !flipped; attempt++ {
+		// trapdoors and levers toggle, if update of earlier click came
+		// late clicking again would toggle the block back
+		if state := a.blocks.State(pos); a.blocks.Changes(pos) != changes || (state != blockUnknown && state != before) {
+			flipped = true
+			break
+		}
+		log.Printf("Chamber %d in room %s did not change state on attempt %d", chamber.Index, a.room.RoomName, attempt)
+		sendActivation(*a.client, a.room, cid)
+		_, flipped = a.blocks.WaitChange(pos, before, blockChangeTimeout)
+	}
+	if !flipped {
+		return "", &ErrorActivationUnverified{chamber.Index, a.room.ActivationRetries + 1, a.blocks.State(pos)}
+	}
+	if pearls == 0 {
+		return fmt.Sprintf("chamber %d activated, but no pearl was seen in it", chamber.Index), nil
+	}
+	if a.pearls.WaitGone(pos, pearlGoneTimeout) {
+		return fmt.Sprintf("chamber %d activated, pearl is gone", chamber.Index), nil
+	}
+	return fmt.Sprintf("chamber %d activated, but pearl is still there", chamber.Index), nil
+}
+
+// activate activates chamber cid or every chamber of the room if cid is -1
+func (a *activator) activate(cid int) (string, error) {
+	if cid != -1 {
+		return a.activateChamber(cid)
+	}
+	notes := []string{}
+	failed := []string{}
+	for c := range a.room.Chambers {
+		note, err := a.activateChamber(c)
+		if err != nil {
+			failed = append(failed, err.Error())
+		} else {
+			notes = append(notes, note)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	if len(failed) > 0 {
+		return strings.Join(notes, "\n"), errors.New(strings.Join(failed, "\n"))
+	}
+	return strings.Join(notes, "\n"), nil
+}
+
+// activationOutcome is the final state of an activation attempt
+type activationOutcome int
+
+const (
+	activationActivated activationOutcome = iota
+	activationTimedOut
+	activationKicked
+	activationWrongGamemode
+	activationSkipped
+	activationFailed
+)
+
+type activationResult struct {
+	Outcome activationOutcome
+	Detail  string
+}
+
+// name is how outcome is written to audit log
+func (o activationOutcome) name() string {
+	switch o {
+	case activationActivated:
+		return "activated"
+	case activationTimedOut:
+		return "timed out"
+	case activationKicked:
+		return "kicked"
+	case activationWrongGamemode:
+		return "wrong gamemode"
+	case activationSkipped:
+		return "skipped"
+	}
+	return "failed"
+}
+
+func (r activationResult) String() string {
+	ret := ""
+	switch r.Outcome {
+	case activationActivated:
+		ret = ":white_check_mark: Activated"
+	case activationTimedOut:
+		ret = ":hourglass: Timed out"
+	case activationKicked:
+		ret = ":boot: Kicked"
+	case activationWrongGamemode:
+		ret = ":no_entry: Wrong gamemode"
+	case activationSkipped:
+		ret = ":fast_forward: Skipped"
+	default:
+		ret = ":interrobang: Failed"
+	}
+	if r.Detail != "" {
+		ret += ": " + r.Detail
+	}
+	return ret
+}
+
+func triggerChamber(s *discordgo.Session, status *statusMessage, room PearlRoom, cid int, auth bot.Auth) activationResult {
 	mcClient := bot.NewClient()
 	mcClient.Auth = auth
 	mcPlayer := basic.NewPlayer(mcClient, basic.Settings{Locale: "en_US"})
-	activateRoutine := func() {
-		s.ChannelMessageSend(room.DiscordChannel, fmt.Sprintf("Logged in (%d), activating...", mcPlayer.Gamemode))
-		time.Sleep(500 * time.Millisecond)
-		if cid == -1 {
-			for c := range room.Chambers {
-				sendActivation(*mcClient, room, c)
-				time.Sleep(500 * time.Millisecond)
-			}
-		} else {
-			sendActivation(*mcClient, room, cid)
+	act := newActivator(mcClient, room)
+	defer registerBot(mcClient, mcPlayer, room).unregister()
+	inGame := make(chan struct{})
+	var inGameOnce sync.Once
+	results := make(chan activationResult, 1)
+	finish := func(r activationResult) {
+		select {
+		case results <- r:
+		default:
 		}
-		s.ChannelMessageSend(room.DiscordChannel, "Activated.")
-		time.Sleep(400 * time.Millisecond)
-		mcClient.Close()
 	}
 	basic.EventsListener{
-		GameStart: func() error {
-			if mcPlayer.WorldInfo.HashedSeed == -4189754411863869379 {
-				return nil
-			}
-			if mcPlayer.Gamemode == 0 {
-				go activateRoutine()
-			}
-			return nil
-		},
-		ChatMsg: nil,
 		Disconnect: func(c chat.Message) error {
-			s.ChannelMessageSend(room.DiscordChannel, "I got disconnected for this reason: "+c.ClearString())
+			finish(activationResult{activationKicked, c.ClearString()})
 			return nil
 		},
 		Death: func() error {
-			s.ChannelMessageSend(room.DiscordChannel, "Yo wtf I died!")
+			finish(activationResult{activationSkipped, "bot died"})
+			return nil
+		},
+	}.Attach(mcClient)
+	queue := queueReporter{status: status}
+	joinListener{
+		Player: mcPlayer,
+		InGame: func() error {
+			inGameOnce.Do(func() {
+				close(inGame)
+				if mcPlayer.Gamemode != 0 {
+					finish(activationResult{activationWrongGamemode, fmt.Sprintf("bot is in gamemode %d", mcPlayer.Gamemode)})
+					return
+				}
+				go func() {
+					status.Update("Logged in, activating...")
+					time.Sleep(500 * time.Millisecond)
+					if warning := act.emptyWarning(cid); warning != "" {
+						status.Update(warning + ", activating anyway...")
+					}
+					note, err := act.activate(cid)
+					time.Sleep(400 * time.Millisecond)
+					if err != nil {
+						finish(activationResult{activationFailed, err.Error()})
+					} else {
+						finish(activationResult{activationActivated, note})
+					}
+				}()
+			})
+			return nil
+		},
+		Queue: func(q queueStatus) error {
+			queue.Report(q)
 			return nil
 		},
 	}.Attach(mcClient)
+	deadline := time.NewTimer(room.activationTimeout())
+	defer deadline.Stop()
 	err := mcClient.JoinServer(room.ServerAdress)
 	if err != nil {
-		s.ChannelMessageSend(room.DiscordChannel, "Error auth: "+err.Error())
-		return
+		r := activationResult{activationFailed, "unable to join: " + err.Error()}
+		status.Update(r.String())
+		return r
+	}
+	status.Update("Joined server, waiting to get in game...")
+	handleErr := make(chan error, 1)
+	go func() {
+		handleErr <- mcClient.HandleGame()
+	}()
+	var r activationResult
+	select {
+	case r = <-results:
+	case err := <-handleErr:
+		r = activationResult{activationFailed, "connection lost: " + err.Error()}
+	case <-deadline.C:
+		select {
+		case <-inGame:
+			r = activationResult{activationTimedOut, "activation did not finish in time"}
+		default:
+			r = activationResult{activationTimedOut, "still in queue"}
+		}
 	}
-	go mcClient.HandleGame()
-	time.Sleep(10000 * time.Millisecond)
 	mcClient.Close()
-
-	// mcClient.Conn.WritePacket(pk.Marshal(
-	// 	0x14,
-	// 	pk.Float(-106.0), //cursor x
-	// 	pk.Float(34.0),   //y
-	// 	pk.Boolean(true), //on ground
-	// ))
-
+	status.Update(r.String())
+	return r
 }
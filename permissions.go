@@ -0,0 +1,106 @@
+package main
+
+import (
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Capabilities that can be granted to Discord roles and users
+const (
+	capabilityActivate    = "activate"
+	capabilityManageRooms = "manage-rooms"
+	capabilityManageAuth  = "manage-auth"
+	capabilityAdminConfig = "admin-config"
+	capabilityAll         = "*"
+)
+
+var allCapabilities = []string{capabilityActivate, capabilityManageRooms, capabilityManageAuth, capabilityAdminConfig}
+
+// PermissionsConfig maps Discord role and user IDs to capabilities,
+// Everyone lists capabilities of every member
+type PermissionsConfig struct {
+	Roles    map[string][]string `json:"roles"`
+	Users    map[string][]string `json:"users"`
+	Everyone []string            `json:"everyone"`
+}
+
+// commandCapabilities is what command or "command subcommand" requires,
+// subcommand entry takes precedence, commands not listed are open for everyone
+var commandCapabilities = map[string]string{
+	"config":       capabilityAdminConfig,
+	"auth":         capabilityManageAuth,
+	"activate":     capabilityActivate,
+	"room":         capabilityManageRooms,
+	"chamber":      capabilityManageRooms,
+	"chamber list": "",
+	// chamber owners manage their chambers, commandChamber checks ownership
+	"chamber label":   capabilityActivate,
+	"chamber allow":   capabilityActivate,
+	"chamber deny":    capabilityActivate,
+	"audit":           capabilityAdminConfig,
+	"bots disconnect": capabilityManageRooms,
+	"auth rotate-key": capabilityAdminConfig,
+}
+
+func requiredCapability(data discordgo.ApplicationCommandInteractionData) string {
+	if len(data.Options) > 0 && data.Options[0].Type == discordgo.ApplicationCommandOptionSubCommand {
+		if c, ok := commandCapabilities[data.Name+" "+data.Options[0].Name]; ok {
+			return c
+		}
+	}
+	return commandCapabilities[data.Name]
+}
+
+func capabilityListed(list []string, capability string) bool {
+	for _, c := range list {
+		if c == capability || c == capabilityAll {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCapability tells if interaction author has capability by user ID or any
+// of their roles, without permissions config everyone can do everything
+func hasCapability(i *discordgo.InteractionCreate, capability string) bool {
+	if capability == "" {
+		return true
+	}
+	perms := getConfig().Permissions
+	if perms == nil {
+		return true
+	}
+	if capabilityListed(perms.Everyone, capability) {
+		return true
+	}
+	if capabilityListed(perms.Users[interactionUserID(i)], capability) {
+		return true
+	}
+	if i.Member != nil {
+		for _, r := range i.Member.Roles {
+			if capabilityListed(perms.Roles[r], capability) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkCommandPermission denies interaction with ephemeral reply if
+// author is missing capability required by the command
+func checkCommandPermission(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	data := i.ApplicationCommandData()
+	capability := requiredCapability(data)
+	if hasCapability(i, capability) {
+		return true
+	}
+	log.Printf("Denied /%s to %s: missing %s", data.Name, interactionUserID(i), capability)
+	writeAudit(s, auditEntry{
+		Action: "denied",
+		User:   interactionUserID(i),
+		Detail: "/" + data.Name + " requires " + capability,
+	})
+	iEphemeralResponse(s, i, "You are not allowed to do that, `"+capability+"` capability is required")
+	return false
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestRequiredCapability(t *testing.T) {
+	tests := []struct {
+		command    string
+		subcommand string
+		want       string
+	}{
+		{"activate", "", capabilityActivate},
+		{"chamber", "add", capabilityManageRooms},
+		{"chamber", "remove", capabilityManageRooms},
+		{"chamber", "list", ""},
+		{"chamber", "label", capabilityActivate},
+		{"chamber", "allow", capabilityActivate},
+		{"chamber", "deny", capabilityActivate},
+		{"auth", "check", capabilityManageAuth},
+		{"auth", "rotate-key", capabilityAdminConfig},
+		{"help", "", ""},
+	}
+	for _, tt := range tests {
+		data := discordgo.ApplicationCommandInteractionData{Name: tt.command}
+		if tt.subcommand != "" {
+			data.Options = []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: tt.subcommand, Type: discordgo.ApplicationCommandOptionSubCommand},
+			}
+		}
+		if got := requiredCapability(data); got != tt.want {
+			t.Errorf("/%s %s: got %q, want %q", tt.command, tt.subcommand, got, tt.want)
+		}
+	}
+}
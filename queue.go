@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tnze/go-mc/bot"
+	"github.com/Tnze/go-mc/bot/basic"
+	"github.com/Tnze/go-mc/chat"
+	"github.com/Tnze/go-mc/data/packetid"
+	"github.com/Tnze/go-mc/nbt"
+	pk "github.com/Tnze/go-mc/net/packet"
+)
+
+var (
+	queuePositionRegexp = regexp.MustCompile(`(?i)position in queue:?\s*(\d+)`)
+	queueETARegexp      = regexp.MustCompile(`(?i)estimated time:?\s*([0-9dhms ]*[0-9][dhms])`)
+)
+
+// queueStatus is what queue server told us about our position
+type queueStatus struct {
+	Position int
+	ETA      string
+}
+
+func parseQueueMessage(msg string) (q queueStatus, ok bool) {
+	m := queuePositionRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		return q, false
+	}
+	q.Position, _ = strconv.Atoi(m[1])
+	if e := queueETARegexp.FindStringSubmatch(msg); e != nil {
+		q.ETA = strings.TrimSpace(e[1])
+	}
+	return q, true
+}
+
+// joinListener follows player from login through queue into the game.
+// InGame is called when player is spawned in a world that is not a queue,
+// Queue is called each time queue server reports position.
+type joinListener struct {
+	Player *basic.Player
+	InGame func() error
+	Queue  func(q queueStatus) error
+}
+
+func (l joinListener) Attach(c *bot.Client) {
+	c.Events.AddListener(
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundLogin, F: l.onJoinGame},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundRespawn, F: l.onRespawn},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundChat, F: l.onChatMsg},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundTabList, F: l.onTabList},
+	)
+}
+
+func (l joinListener) onJoinGame(_ pk.Packet) error {
+	if l.Player.HashedSeed == queueServerHashedSeed || l.InGame == nil {
+		return nil
+	}
+	return l.InGame()
+}
+
+// onRespawn catches transfer from queue server into the game since
+// proxies do not send login packet second time
+func (l joinListener) onRespawn(p pk.Packet) error {
+	var (
+		worldName    pk.Identifier
+		hashedSeed   pk.Long
+		gamemode     pk.UnsignedByte
+		prevGamemode pk.Byte
+	)
+	if err := p.Scan(pk.NBT(new(nbt.RawMessage)), &worldName, &hashedSeed, &gamemode, &prevGamemode); err != nil {
+		return err
+	}
+	l.Player.WorldName = string(worldName)
+	l.Player.HashedSeed = int64(hashedSeed)
+	l.Player.Gamemode = byte(gamemode)
+	l.Player.PrevGamemode = int8(prevGamemode)
+	return l.onJoinGame(p)
+}
+
+func (l joinListener) onChatMsg(p pk.Packet) error {
+	var msg chat.Message
+	if err := p.Scan(&msg); err != nil {
+		return err
+	}
+	return l.onQueueText(msg.ClearString())
+}
+
+func (l joinListener) onTabList(p pk.Packet) error {
+	var header, footer chat.Message
+	if err := p.Scan(&header, &footer); err != nil {
+		return err
+	}
+	return l.onQueueText(header.ClearString() + "\n" + footer.ClearString())
+}
+
+func (l joinListener) onQueueText(text string) error {
+	if l.Queue == nil {
+		return nil
+	}
+	if q, ok := parseQueueMessage(text); ok {
+		return l.Queue(q)
+	}
+	return nil
+}
+
+const queueReportInterval = 5 * time.Second
+
+// queueReporter turns queue updates into Discord status edits, estimating
+// time left from observed queue speed when server does not tell it
+type queueReporter struct {
+	status       *statusMessage
+	started      time.Time
+	startedPos   int
+	lastReported time.Time
+	lastPos      int
+}
+
+func (r *queueReporter) Report(q queueStatus) {
+	now := time.Now()
+	if r.started.IsZero() {
+		r.started = now
+		r.startedPos = q.Position
+	}
+	if q.Position == r.lastPos || now.Sub(r.lastReported) < queueReportInterval {
+		return
+	}
+	r.lastPos = q.Position
+	r.lastReported = now
+	eta := q.ETA
+	if eta == "" {
+		eta = "unknown"
+		if moved := r.startedPos - q.Position; moved > 0 {
+			perPosition := now.Sub(r.started) / time.Duration(moved)
+			eta = (perPosition * time.Duration(q.Position)).Round(time.Second).String()
+		}
+	}
+	r.status.Update(fmt.Sprintf("Waiting in queue, position %d, estimated time %s", q.Position, eta))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	defaultTokenRefreshInterval = 10 * time.Minute
+	// Minecraft token is refreshed when it has less than that left,
+	// Microsoft refresh token is checked along with it
+	tokenRefreshAhead = 2 * time.Hour
+)
+
+var (
+	tokenRefresherStop chan struct{}
+	tokenRefresherDone chan struct{}
+	// accounts that were already reported as broken, to not repeat warnings
+	tokenRefreshWarned = map[string]bool{}
+)
+
+// tokenRefreshInterval is how often accounts are checked, configured in seconds
+func (c BotConfiguration) tokenRefreshInterval() time.Duration {
+	if c.TokenRefreshInterval <= 0 {
+		return defaultTokenRefreshInterval
+	}
+	return time.Duration(c.TokenRefreshInterval) * time.Second
+}
+
+func startTokenRefresher(s *discordgo.Session) {
+	tokenRefresherStop = make(chan struct{})
+	tokenRefresherDone = make(chan struct{})
+	go func() {
+		defer close(tokenRefresherDone)
+		for {
+			refreshAllAccounts(s)
+			select {
+			case <-tokenRefresherStop:
+				return
+			case <-time.After(getConfig().tokenRefreshInterval()):
+			}
+		}
+	}()
+}
+
+func stopTokenRefresher() {
+	close(tokenRefresherStop)
+	<-tokenRefresherDone
+}
+
+// accountOwners lists credentials names of all rooms with owners of rooms using them
+func accountOwners() map[string][]string {
+	ret := map[string][]string{}
+	for _, r := range getConfig().PearlRooms {
+		owners := ret[r.AccountCredentialsName]
+		known := r.AccountOwner == ""
+		for _, o := range owners {
+			known = known || o == r.AccountOwner
+		}
+		if !known {
+			owners = append(owners, r.AccountOwner)
+		}
+		ret[r.AccountCredentialsName] = owners
+	}
+	return ret
+}
+
+func refreshAllAccounts(s *discordgo.Session) {
+	var wg sync.WaitGroup
+	results := map[string]error{}
+	var resultsLock sync.Mutex
+	owners := accountOwners()
+	for name := range owners {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			err := refreshAccountAhead(s, name)
+			resultsLock.Lock()
+			results[name] = err
+			resultsLock.Unlock()
+		}(name)
+	}
+	wg.Wait()
+	for name, err := range results {
+		if err == nil {
+			delete(tokenRefreshWarned, name)
+			continue
+		}
+		log.Printf("Background refresh of %s failed: %v", name, err)
+		// everything else fails when services are down, that fixes itself
+		var rejected *ErrorRefreshTokenRejected
+		if !errors.As(err, &rejected) || tokenRefreshWarned[name] {
+			continue
+		}
+		tokenRefreshWarned[name] = true
+		warnTokenRefresh(s, name, owners[name], err)
+	}
+}
+
+// refreshAccountAhead refreshes tokens of the account if Minecraft token
+// expires soon, nothing is done for accounts that are fine
+func refreshAccountAhead(s *discordgo.Session, name string) error {
+	started := time.Now()
+	refreshed, err := accounts.RefreshExpiring(name, tokenRefreshAhead)
+	if !refreshed {
+		return err
+	}
+	e := auditEntry{Action: "auth refresh", Result: "ok", Detail: "background refresh of " + name, Duration: time.Since(started)}
+	if err != nil {
+		e.Result = "failed"
+		e.Detail += ": " + err.Error()
+	}
+	writeAudit(s, e)
+	return err
+}
+
+// warnTokenRefresh tells account owners and service channel that
+// account needs attention, most likely a new /auth new
+func warnTokenRefresh(s *discordgo.Session, name string, owners []string, err error) {
+	msg := "Microsoft refresh token of credentials `" + name + "` is no longer accepted, activations will fail until it is fixed with `/auth new`: " + err.Error()
+	for _, o := range owners {
+		ch, err := s.UserChannelCreate(o)
+		if err != nil {
+			log.Printf("Failed to open DM with %s: %v", o, err)
+			continue
+		}
+		_, err = s.ChannelMessageSend(ch.ID, msg)
+		if err != nil {
+			log.Printf("Failed to DM %s: %v", o, err)
+		}
+	}
+	if channel := getConfig().DiscordServiceChannel; channel != "" {
+		_, err := s.ChannelMessageSend(channel, msg)
+		if err != nil {
+			log.Printf("Failed to post to service channel: %v", err)
+		}
+	}
+}
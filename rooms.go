@@ -0,0 +1,417 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func coordinateOptions(what string) []*discordgo.ApplicationCommandOption {
+	ret := []*discordgo.ApplicationCommandOption{}
+	for _, axis := range []string{"x", "y", "z"} {
+		ret = append(ret, &discordgo.ApplicationCommandOption{
+			Type:        applicationCommandOptionNumber,
+			Name:        axis,
+			Description: strings.ToUpper(axis) + " coordinate of " + what,
+			Required:    true,
+		})
+	}
+	return ret
+}
+
+func roomOption() *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "room",
+		Description: "Selected room",
+		Required:    false,
+	}
+}
+
+func mechanismOption() *discordgo.ApplicationCommandOption {
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, m := range []string{mechanismTrapdoor, mechanismTrapdoorTop, mechanismButton, mechanismLever, mechanismNoteBlock, mechanismFenceGate} {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: m, Value: m})
+	}
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "mechanism",
+		Description: "Block that releases the pearl",
+		Required:    false,
+		Choices:     choices,
+	}
+}
+
+func choicesOption(name, description string, values []string) *discordgo.ApplicationCommandOption {
+	choices := []*discordgo.ApplicationCommandOptionChoice{}
+	for _, v := range values {
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: v, Value: v})
+	}
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        name,
+		Description: description,
+		Required:    false,
+		Choices:     choices,
+	}
+}
+
+func faceOption() *discordgo.ApplicationCommandOption {
+	return choicesOption("face", "What button or lever is attached to (face on F3 screen)", chamberFaces)
+}
+
+func facingOption() *discordgo.ApplicationCommandOption {
+	return choicesOption("facing", "Where button, lever or fence gate is turned (facing on F3 screen)", chamberFacings)
+}
+
+func chamberIndexOption() *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionInteger,
+		Name:        "index",
+		Description: "Chamber index",
+		Required:    true,
+	}
+}
+
+func labelOption(required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "label",
+		Description: "Chamber label",
+		Required:    required,
+	}
+}
+
+func userOption(name, description string, required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionUser,
+		Name:        name,
+		Description: description,
+		Required:    required,
+	}
+}
+
+func stringOption(name, description string) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        name,
+		Description: description,
+		Required:    true,
+	}
+}
+
+// findRoomIndex finds room by name among rooms of the channel, name may
+// be omitted if channel has only one room
+func findRoomIndex(conf *BotConfiguration, channelID, roomname string) (int, error) {
+	found := []int{}
+	for i, r := range conf.PearlRooms {
+		if r.DiscordChannel == channelID && (roomname == "" || r.RoomName == roomname) {
+			found = append(found, i)
+		}
+	}
+	if len(found) == 1 {
+		return found[0], nil
+	}
+	if roomname != "" {
+		return -1, fmt.Errorf("Room `%s` not found", roomname)
+	}
+	if len(found) == 0 {
+		return -1, errors.New("Channel does not have any rooms attached")
+	}
+	return -1, errors.New("Channel have more than one room attached, please specify room name")
+}
+
+// findManagedRoom finds room like findRoomIndex does and checks that user is allowed to change it
+func findManagedRoom(conf *BotConfiguration, i *discordgo.InteractionCreate, roomname string) (*PearlRoom, error) {
+	index, err := findRoomIndex(conf, i.ChannelID, roomname)
+	if err != nil {
+		return nil, err
+	}
+	room := &conf.PearlRooms[index]
+	if room.AccountOwner != "" && room.AccountOwner != interactionUserID(i) {
+		return nil, fmt.Errorf("Only owner of room `%s` can manage it", room.RoomName)
+	}
+	return room, nil
+}
+
+func findChamberIndex(room *PearlRoom, index int) int {
+	for i, c := range room.Chambers {
+		if c.Index == index {
+			return i
+		}
+	}
+	return -1
+}
+
+// name is how chamber is shown to users, label if it has one
+func (c Chamber) name() string {
+	if c.Label != "" {
+		return fmt.Sprintf("%d `%s`", c.Index, c.Label)
+	}
+	return strconv.Itoa(c.Index)
+}
+
+// chamberString is how chamber cid (or every chamber if it is -1) is
+// shown in status messages
+func (r PearlRoom) chamberString(cid int) string {
+	if cid == -1 {
+		return "every chamber"
+	}
+	return "chamber " + r.Chambers[cid].name()
+}
+
+// chamberIndex is Chamber.Index of chamber cid or -1 for every chamber,
+// unlike position in the room it does not change when others are removed
+func (r PearlRoom) chamberIndex(cid int) int {
+	if cid == -1 {
+		return -1
+	}
+	return r.Chambers[cid].Index
+}
+
+// findChamber finds chamber by label or index
+func findChamber(room PearlRoom, name string) int {
+	for i, c := range room.Chambers {
+		if c.Label != "" && c.Label == name {
+			return i
+		}
+	}
+	if index, err := strconv.Atoi(name); err == nil {
+		return findChamberIndex(&room, index)
+	}
+	return -1
+}
+
+// mayActivate tells if user is allowed to activate chamber, room owner can
+// activate everything and others only chambers they own or are allowed to
+func (r PearlRoom) mayActivate(cid int, userID string) bool {
+	if r.SharedChambers || r.AccountOwner == userID {
+		return true
+	}
+	c := r.Chambers[cid]
+	if c.Owner == "" || c.Owner == userID {
+		return true
+	}
+	for _, u := range c.AllowedUsers {
+		if u == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func optionPos(options map[string]*discordgo.ApplicationCommandInteractionDataOption) []float64 {
+	return []float64{options["x"].FloatValue(), options["y"].FloatValue(), options["z"].FloatValue()}
+}
+
+// auditConfigEdit records room or chamber change, resp describes what was changed
+func auditConfigEdit(s *discordgo.Session, i *discordgo.InteractionCreate, action, roomname string, err error, resp string) {
+	e := auditEntry{Action: action, User: interactionUserID(i), Room: roomname, Result: "ok", Detail: resp}
+	if err != nil {
+		e.Result = "failed"
+		e.Detail = err.Error()
+	}
+	writeAudit(s, e)
+}
+
+func commandRoom(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	cmd := i.ApplicationCommandData().Options[0]
+	opts := optionsMap(cmd.Options)
+	roomname := optionString(opts, "room")
+	resp := ""
+	err := editConfig(func(conf *BotConfiguration) error {
+		if cmd.Name == "create" {
+			room := PearlRoom{
+				Chambers:               []Chamber{},
+				AccountOwner:           interactionUserID(i),
+				AccountCredentialsName: optionString(opts, "credentials"),
+				DiscordChannel:         i.ChannelID,
+				RoomName:               optionString(opts, "name"),
+				ServerAdress:           optionString(opts, "server"),
+				BotPos:                 optionPos(opts),
+			}
+			conf.PearlRooms = append(conf.PearlRooms, room)
+			resp = "Room `" + room.RoomName + "` created"
+			return nil
+		}
+		room, err := findManagedRoom(conf, i, roomname)
+		if err != nil {
+			return err
+		}
+		switch cmd.Name {
+		case "delete":
+			resp = "Room `" + room.RoomName + "` deleted"
+			for index := range conf.PearlRooms {
+				if &conf.PearlRooms[index] == room {
+					conf.PearlRooms = append(conf.PearlRooms[:index], conf.PearlRooms[index+1:]...)
+					break
+				}
+			}
+		case "rename":
+			room.RoomName = optionString(opts, "name")
+			resp = "Room renamed to `" + room.RoomName + "`"
+		case "set-server":
+			room.ServerAdress = optionString(opts, "server")
+			resp = "Room `" + room.RoomName + "` server set to `" + room.ServerAdress + "`"
+		case "set-botpos":
+			room.BotPos = optionPos(opts)
+			for c := range room.Chambers {
+				if err := checkReach(*room, c); err != nil {
+					return err
+				}
+			}
+			resp = fmt.Sprintf("Room `%s` bot position set to %v", room.RoomName, room.BotPos)
+		case "set-account":
+			room.AccountCredentialsName = optionString(opts, "credentials")
+			resp = "Room `" + room.RoomName + "` now uses credentials `" + room.AccountCredentialsName + "`"
+		default:
+			return errors.New("Allowed subcommands: create, delete, rename, set-server, set-botpos, set-account")
+		}
+		return nil
+	})
+	if cmd.Name == "create" {
+		roomname = optionString(opts, "name")
+	}
+	auditConfigEdit(s, i, "room "+cmd.Name, roomname, err, resp)
+	if err != nil {
+		iTextResponse(s, i, err.Error())
+		return
+	}
+	syncRoomSessions(s)
+	iTextResponse(s, i, resp)
+}
+
+// accessString tells who owns chamber and who else may activate it
+func (c Chamber) accessString() string {
+	parts := []string{}
+	if c.Owner != "" {
+		parts = append(parts, "owned by <@"+c.Owner+">")
+	}
+	if len(c.AllowedUsers) > 0 {
+		allowed := []string{}
+		for _, u := range c.AllowedUsers {
+			allowed = append(allowed, "<@"+u+">")
+		}
+		parts = append(parts, "allowed "+strings.Join(allowed, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func commandChamber(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	cmd := i.ApplicationCommandData().Options[0]
+	opts := optionsMap(cmd.Options)
+	roomname := optionString(opts, "room")
+	userID := interactionUserID(i)
+	if cmd.Name == "list" {
+		conf := getConfig()
+		index, err := findRoomIndex(conf, i.ChannelID, roomname)
+		if err != nil {
+			iTextResponse(s, i, err.Error())
+			return
+		}
+		room := conf.PearlRooms[index]
+		resp := fmt.Sprintf("Room `%s` has %d chambers\n", room.RoomName, len(room.Chambers))
+		for _, c := range room.Chambers {
+			resp += fmt.Sprintf("[%s] %s at %v", c.name(), c.mechanismString(), c.Pos)
+			if access := c.accessString(); access != "" {
+				resp += " " + access
+			}
+			resp += "\n"
+		}
+		iQuietTextResponse(s, i, resp)
+		return
+	}
+	resp := ""
+	err := editConfig(func(conf *BotConfiguration) error {
+		roomindex, err := findRoomIndex(conf, i.ChannelID, roomname)
+		if err != nil {
+			return err
+		}
+		room := &conf.PearlRooms[roomindex]
+		index := int(opts["index"].IntValue())
+		cid := findChamberIndex(room, index)
+		if cid == -1 && cmd.Name != "add" {
+			return fmt.Errorf("Chamber %d in room `%s` not found", index, room.RoomName)
+		}
+		// chamber owner can share and label own chamber, everything else is up to room owner
+		chamberOwned := cid != -1 && room.Chambers[cid].Owner == userID && (cmd.Name == "label" || cmd.Name == "allow" || cmd.Name == "deny")
+		if room.AccountOwner != "" && room.AccountOwner != userID && !chamberOwned {
+			return fmt.Errorf("Only owner of room `%s` can manage it", room.RoomName)
+		}
+		// label, allow and deny need only activate capability to get here
+		if !chamberOwned && !hasCapability(i, capabilityManageRooms) {
+			return fmt.Errorf("Only owner of chamber %d can change it without `%s` capability", index, capabilityManageRooms)
+		}
+		switch cmd.Name {
+		case "add":
+			if cid != -1 {
+				return fmt.Errorf("Chamber %d already exists in room `%s`", index, room.RoomName)
+			}
+			owner := userID
+			if o, ok := opts["owner"]; ok {
+				owner = o.UserValue(nil).ID
+			}
+			room.Chambers = append(room.Chambers, Chamber{
+				Index:     index,
+				Pos:       optionPos(opts),
+				Mechanism: optionString(opts, "mechanism"),
+				Face:      optionString(opts, "face"),
+				Facing:    optionString(opts, "facing"),
+				Label:     optionString(opts, "label"),
+				Owner:     owner,
+			})
+			cid = len(room.Chambers) - 1
+			resp = fmt.Sprintf("Chamber %s added to room `%s`", room.Chambers[cid].name(), room.RoomName)
+		case "remove":
+			room.Chambers = append(room.Chambers[:cid], room.Chambers[cid+1:]...)
+			resp = fmt.Sprintf("Chamber %d removed from room `%s`", index, room.RoomName)
+			return nil
+		case "move":
+			room.Chambers[cid].Pos = optionPos(opts)
+			if m := optionString(opts, "mechanism"); m != "" {
+				room.Chambers[cid].Mechanism = m
+			}
+			if f := optionString(opts, "face"); f != "" {
+				room.Chambers[cid].Face = f
+			}
+			if f := optionString(opts, "facing"); f != "" {
+				room.Chambers[cid].Facing = f
+			}
+			resp = fmt.Sprintf("Chamber %d in room `%s` moved to %v", index, room.RoomName, room.Chambers[cid].Pos)
+		case "label":
+			room.Chambers[cid].Label = optionString(opts, "label")
+			resp = fmt.Sprintf("Chamber %d in room `%s` is now labeled `%s`", index, room.RoomName, room.Chambers[cid].Label)
+		case "allow":
+			user := opts["user"].UserValue(nil).ID
+			if stringListed(room.Chambers[cid].AllowedUsers, user) {
+				resp = fmt.Sprintf("<@%s> is already allowed to activate chamber %s", user, room.Chambers[cid].name())
+				break
+			}
+			room.Chambers[cid].AllowedUsers = append(room.Chambers[cid].AllowedUsers, user)
+			resp = fmt.Sprintf("<@%s> is now allowed to activate chamber %s", user, room.Chambers[cid].name())
+		case "deny":
+			user := opts["user"].UserValue(nil).ID
+			allowed := []string{}
+			for _, u := range room.Chambers[cid].AllowedUsers {
+				if u != user {
+					allowed = append(allowed, u)
+				}
+			}
+			room.Chambers[cid].AllowedUsers = allowed
+			resp = fmt.Sprintf("<@%s> is no longer allowed to activate chamber %s", user, room.Chambers[cid].name())
+		default:
+			return errors.New("Allowed subcommands: add, remove, move, label, allow, deny, list")
+		}
+		return checkReach(*room, cid)
+	})
+	auditConfigEdit(s, i, "chamber "+cmd.Name, roomname, err, resp)
+	if err != nil {
+		iTextResponse(s, i, err.Error())
+		return
+	}
+	syncRoomSessions(s)
+	iQuietTextResponse(s, i, resp)
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestChamberAccessString(t *testing.T) {
+	tests := []struct {
+		chamber Chamber
+		want    string
+	}{
+		{Chamber{}, ""},
+		{Chamber{Owner: "1"}, "owned by <@1>"},
+		{Chamber{AllowedUsers: []string{"2", "3"}}, "allowed <@2>, <@3>"},
+		{Chamber{Owner: "1", AllowedUsers: []string{"2"}}, "owned by <@1>, allowed <@2>"},
+	}
+	for _, tt := range tests {
+		if got := tt.chamber.accessString(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.chamber, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Tnze/go-mc/bot"
+	"github.com/Tnze/go-mc/bot/basic"
+	"github.com/Tnze/go-mc/chat"
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	sessionReconnectMin     = 5 * time.Second
+	sessionReconnectMax     = 5 * time.Minute
+	sessionActivationsQueue = 8
+)
+
+// sessionExpireInterval is how often activations waiting for session are
+// checked for timeout
+var sessionExpireInterval = 5 * time.Second
+
+// roomSession keeps Minecraft client of a room logged in so activation
+// does not have to go through login (and queue) every time.
+type roomSession struct {
+	// server can not change without logging in again
+	server string
+	// room is owned by session goroutine, changes come through rooms
+	room        PearlRoom
+	rooms       chan PearlRoom
+	activations chan sessionActivation
+	stop        chan struct{}
+	done        chan struct{}
+	pending     []sessionActivation
+	// lastErr is why session is not in game, pending activations are told it
+	lastErr error
+}
+
+type sessionActivation struct {
+	// chamber is Chamber.Index or -1 for every chamber, room may be
+	// edited while activation waits so it is looked up when it happens
+	chamber   int
+	status    *statusMessage
+	queue     *queueReporter
+	requested time.Time
+	onResult  func(activationResult)
+}
+
+// finish reports final result of the activation
+func (a sessionActivation) finish(r activationResult) {
+	a.status.Update(r.String())
+	if a.onResult != nil {
+		a.onResult(r)
+	}
+}
+
+var (
+	roomSessions     = map[string]*roomSession{}
+	roomSessionsLock sync.Mutex
+)
+
+func getRoomSession(credentialsName string) *roomSession {
+	roomSessionsLock.Lock()
+	defer roomSessionsLock.Unlock()
+	return roomSessions[credentialsName]
+}
+
+func startRoomSessions(s *discordgo.Session) {
+	roomSessionsLock.Lock()
+	defer roomSessionsLock.Unlock()
+	for _, r := range getConfig().PearlRooms {
+		if r.StayLoggedIn {
+			roomSessions[r.AccountCredentialsName] = newRoomSession(s, r, nil)
+		}
+	}
+}
+
+func stopRoomSessions() {
+	roomSessionsLock.Lock()
+	stopped := []<-chan struct{}{}
+	for k, rs := range roomSessions {
+		stopped = append(stopped, rs.Stop())
+		delete(roomSessions, k)
+	}
+	roomSessionsLock.Unlock()
+	for _, done := range stopped {
+		<-done
+	}
+}
+
+// syncRoomSessions stops sessions of rooms that were removed, no longer
+// stay logged in or moved to other server, other changes are handed to
+// running sessions so they do not have to log in (and queue) again
+func syncRoomSessions(s *discordgo.Session) {
+	roomSessionsLock.Lock()
+	defer roomSessionsLock.Unlock()
+	wanted := map[string]PearlRoom{}
+	for _, r := range getConfig().PearlRooms {
+		if r.StayLoggedIn {
+			wanted[r.AccountCredentialsName] = r
+		}
+	}
+	stopped := map[string]<-chan struct{}{}
+	for k, rs := range roomSessions {
+		if r, ok := wanted[k]; ok && r.ServerAdress == rs.server {
+			rs.updateRoom(r)
+			continue
+		}
+		stopped[k] = rs.Stop()
+		delete(roomSessions, k)
+	}
+	for k, r := range wanted {
+		if _, ok := roomSessions[k]; !ok {
+			// the same account logging in twice would kick the old session
+			roomSessions[k] = newRoomSession(s, r, stopped[k])
+		}
+	}
+}
+
+// newRoomSession starts session, it logs in only after previous session
+// of the account is done if there is one
+func newRoomSession(s *discordgo.Session, room PearlRoom, previous <-chan struct{}) *roomSession {
+	rs := &roomSession{
+		server:      room.ServerAdress,
+		room:        room,
+		rooms:       make(chan PearlRoom, 1),
+		activations: make(chan sessionActivation, sessionActivationsQueue),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go rs.run(s, previous)
+	return rs
+}
+
+// Stop tells session to disconnect, returned channel is closed once it
+// is done. It does not wait so it can be called with roomSessionsLock held.
+func (rs *roomSession) Stop() <-chan struct{} {
+	close(rs.stop)
+	return rs.done
+}
+
+// updateRoom hands changed room settings to the session, only the latest
+// ones matter. Callers hold roomSessionsLock so nothing else sends.
+func (rs *roomSession) updateRoom(r PearlRoom) {
+	select {
+	case <-rs.rooms:
+	default:
+	}
+	rs.rooms <- r
+}
+
+// requestActivation hands activation of chamber cid of room to the
+// session, ahead is how many activations of the account are before this one
+func (rs *roomSession) requestActivation(status *statusMessage, room PearlRoom, cid int, ahead int, onResult func(activationResult)) {
+	a := sessionActivation{chamber: room.chamberIndex(cid), status: status, queue: &queueReporter{status: status}, requested: time.Now(), onResult: onResult}
+	// status is updated before session gets the activation, after that
+	// only session goroutine updates it
+	if ahead > 0 {
+		status.Update(queuedBehindString(ahead))
+	} else {
+		status.Update(fmt.Sprintf("Activation of %s in room %s requested...", room.chamberString(cid), room.RoomName))
+	}
+	select {
+	case rs.activations <- a:
+	default:
+		a.finish(activationResult{activationSkipped, "too many activations are already waiting, try again later"})
+	}
+}
+
+func (rs *roomSession) run(s *discordgo.Session, previous <-chan struct{}) {
+	defer close(rs.done)
+	if previous != nil {
+		select {
+		case <-previous:
+		case <-rs.stop:
+			rs.finishAll(activationResult{activationSkipped, "session was stopped before activation"})
+			return
+		}
+	}
+	backoff := sessionReconnectMin
+	for {
+		started := time.Now()
+		err := rs.serve(s)
+		if errors.Is(err, errSessionStopped) {
+			rs.finishAll(activationResult{activationSkipped, "session was stopped before activation"})
+			return
+		}
+		log.Printf("Room %s session ended: %v", rs.room.RoomName, err)
+		rs.lastErr = err
+		if time.Since(started) > sessionReconnectMax {
+			backoff = sessionReconnectMin
+		}
+		if rs.waitReconnect(backoff, err) {
+			return
+		}
+		backoff *= 2
+		if backoff > sessionReconnectMax {
+			backoff = sessionReconnectMax
+		}
+	}
+}
+
+// waitReconnect waits before next login, activations keep coming and
+// expiring meanwhile and are told why bot is not in game. Tells if
+// session was stopped.
+func (rs *roomSession) waitReconnect(backoff time.Duration, err error) bool {
+	reconnecting := fmt.Sprintf("Bot is not in game: %v\nReconnecting in %s...", err, backoff)
+	for _, a := range rs.pending {
+		a.status.Update(reconnecting)
+	}
+	reconnect := time.After(backoff)
+	expireTicker := time.NewTicker(sessionExpireInterval)
+	defer expireTicker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			rs.finishAll(activationResult{activationSkipped, "session was stopped before activation"})
+			return true
+		case r := <-rs.rooms:
+			rs.room = r
+		case a := <-rs.activations:
+			rs.pending = append(rs.pending, a)
+			a.status.Update(reconnecting)
+		case <-expireTicker.C:
+			rs.expirePending()
+		case <-reconnect:
+			return false
+		}
+	}
+}
+
+var errSessionStopped = errors.New("session stopped")
+
+func (rs *roomSession) finishPending(r activationResult) {
+	for _, a := range rs.pending {
+		a.finish(r)
+	}
+	rs.pending = nil
+}
+
+// finishAll finishes pending activations and ones that were not picked up yet
+func (rs *roomSession) finishAll(r activationResult) {
+	for {
+		select {
+		case a := <-rs.activations:
+			rs.pending = append(rs.pending, a)
+		default:
+			rs.finishPending(r)
+			return
+		}
+	}
+}
+
+// expirePending times out activations that waited longer than room allows
+func (rs *roomSession) expirePending() {
+	left := rs.pending[:0]
+	for _, a := range rs.pending {
+		if time.Since(a.requested) > rs.room.activationTimeout() {
+			detail := "bot did not get in game in time"
+			if rs.lastErr != nil {
+				detail += ": " + rs.lastErr.Error()
+			}
+			a.finish(activationResult{activationTimedOut, detail})
+		} else {
+			left = append(left, a)
+		}
+	}
+	rs.pending = left
+}
+
+// serve logs in and handles activations until client disconnects
+func (rs *roomSession) serve(s *discordgo.Session) error {
+	auth, err := accounts.Auth(rs.room.AccountCredentialsName, nil)
+	if err != nil {
+		return err
+	}
+	mcClient := bot.NewClient()
+	mcClient.Auth = auth
+	mcPlayer := basic.NewPlayer(mcClient, basic.Settings{Locale: "en_US"})
+	act := newActivator(mcClient, rs.room)
+	defer registerBot(mcClient, mcPlayer, rs.room).unregister()
+	joined := make(chan byte, 1)
+	queued := make(chan queueStatus, 1)
+	basic.EventsListener{
+		Disconnect: func(c chat.Message) error {
+			s.ChannelMessageSend(rs.room.DiscordChannel, "I got disconnected for this reason: "+c.ClearString())
+			return nil
+		},
+		Death: func() error {
+			s.ChannelMessageSend(rs.room.DiscordChannel, "Yo wtf I died!")
+			return mcPlayer.Respawn()
+		},
+	}.Attach(mcClient)
+	joinListener{
+		Player: mcPlayer,
+		InGame: func() error {
+			select {
+			case joined <- mcPlayer.Gamemode:
+			default:
+			}
+			return nil
+		},
+		Queue: func(q queueStatus) error {
+			select {
+			case queued <- q:
+			default:
+			}
+			return nil
+		},
+	}.Attach(mcClient)
+	err = mcClient.JoinServer(rs.room.ServerAdress)
+	if err != nil {
+		return err
+	}
+	defer mcClient.Close()
+	handleErr := make(chan error, 1)
+	go func() {
+		handleErr <- mcClient.HandleGame()
+	}()
+	expireTicker := time.NewTicker(sessionExpireInterval)
+	defer expireTicker.Stop()
+	inGame := false
+	for {
+		select {
+		case <-rs.stop:
+			return errSessionStopped
+		case err := <-handleErr:
+			return err
+		case <-expireTicker.C:
+			rs.expirePending()
+		case r := <-rs.rooms:
+			rs.room = r
+			act.setRoom(r)
+		case gamemode := <-joined:
+			inGame = gamemode == 0
+			rs.lastErr = nil
+			if !inGame {
+				rs.finishPending(activationResult{activationWrongGamemode, fmt.Sprintf("bot is in gamemode %d", gamemode)})
+			}
+		case q := <-queued:
+			for _, a := range rs.pending {
+				a.queue.Report(q)
+			}
+		case a := <-rs.activations:
+			rs.pending = append(rs.pending, a)
+			if !inGame {
+				a.status.Update("Bot is not in game yet, activation will happen once it gets there...")
+			}
+		}
+		if !inGame {
+			continue
+		}
+		for _, a := range rs.pending {
+			cid := -1
+			if a.chamber != -1 {
+				if cid = findChamberIndex(&rs.room, a.chamber); cid == -1 {
+					a.finish(activationResult{activationSkipped, fmt.Sprintf("chamber %d was removed from the room", a.chamber)})
+					continue
+				}
+			}
+			msg := fmt.Sprintf("Activating %s in room %s...", rs.room.chamberString(cid), rs.room.RoomName)
+			if warning := act.emptyWarning(cid); warning != "" {
+				msg = warning + "\n" + msg
+			}
+			a.status.Update(msg)
+			if note, err := act.activate(cid); err != nil {
+				a.finish(activationResult{activationFailed, err.Error()})
+			} else {
+				a.finish(activationResult{activationActivated, note})
+			}
+		}
+		rs.pending = nil
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoomSessionWaitReconnect(t *testing.T) {
+	prev := sessionExpireInterval
+	sessionExpireInterval = 10 * time.Millisecond
+	t.Cleanup(func() { sessionExpireInterval = prev })
+
+	f := &fakeDiscord{}
+	s := fakeDiscordSession(t, f)
+	rs := &roomSession{
+		room:        PearlRoom{ActivationTimeout: 1},
+		rooms:       make(chan PearlRoom, 1),
+		activations: make(chan sessionActivation, sessionActivationsQueue),
+		stop:        make(chan struct{}),
+	}
+	joinErr := errors.New("connection refused")
+	rs.lastErr = joinErr
+	results := make(chan activationResult, 1)
+	rs.activations <- sessionActivation{
+		chamber:   1,
+		status:    channelStatus(s, "channel"),
+		requested: time.Now(),
+		onResult:  func(r activationResult) { results <- r },
+	}
+	done := make(chan bool)
+	go func() {
+		done <- rs.waitReconnect(time.Minute, joinErr)
+	}()
+	select {
+	case r := <-results:
+		if r.Outcome != activationTimedOut || !strings.Contains(r.Detail, joinErr.Error()) {
+			t.Errorf("got %s", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("activation was not expired while session waited to reconnect")
+	}
+	close(rs.stop)
+	if stopped := <-done; !stopped {
+		t.Error("stopped session was not reported as stopped")
+	}
+	requests := f.Requests()
+	if len(requests) == 0 || !strings.Contains(requests[0].content, joinErr.Error()) {
+		t.Errorf("activation was not told why bot is not in game: %v", requests)
+	}
+}
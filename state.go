@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runtimeState holds what Discord handlers and background goroutines
+// share. Config is never modified in place, edits work on a copy that
+// replaces current config as a whole.
+type runtimeState struct {
+	config atomic.Value // *BotConfiguration
+	// configEdit serializes loading, saving and editing of config
+	configEdit sync.Mutex
+
+	// activations of everything waiting for confirmation by channel
+	pending     map[string]activationRequest
+	pendingLock sync.Mutex
+}
+
+var state = &runtimeState{pending: map[string]activationRequest{}}
+
+// getConfig returns current config, it must not be modified
+func getConfig() *BotConfiguration {
+	c, _ := state.config.Load().(*BotConfiguration)
+	return c
+}
+
+func setConfig(c *BotConfiguration) {
+	state.config.Store(c)
+}
+
+func (r activationRequest) expired() bool {
+	return time.Since(r.when) > dangerousActivationTimeout
+}
+
+// requestPending stores activation waiting for confirmation in the
+// channel, if channel already has one that is not expired it is
+// returned and nothing is stored
+func (st *runtimeState) requestPending(channelID string, r activationRequest) (activationRequest, bool) {
+	st.pendingLock.Lock()
+	defer st.pendingLock.Unlock()
+	if prev, ok := st.pending[channelID]; ok && !prev.expired() {
+		return prev, false
+	}
+	st.pending[channelID] = r
+	return r, true
+}
+
+// takePending returns activation waiting for confirmation in the channel,
+// it is removed only if it was requested by userID
+func (st *runtimeState) takePending(channelID, userID string) (activationRequest, bool) {
+	st.pendingLock.Lock()
+	defer st.pendingLock.Unlock()
+	r, ok := st.pending[channelID]
+	if ok && r.byUser == userID {
+		delete(st.pending, channelID)
+	}
+	return r, ok
+}
+
+// expirePending forgets activations that were not confirmed in time
+func (st *runtimeState) expirePending() {
+	st.pendingLock.Lock()
+	defer st.pendingLock.Unlock()
+	for k, r := range st.pending {
+		if r.expired() {
+			log.Printf("Activation of everything in room %s requested by %s expired", r.roomname, r.byUser)
+			delete(st.pending, k)
+		}
+	}
+}
+
+// expireLoop runs expirePending until stop is closed
+func (st *runtimeState) expireLoop(stop <-chan struct{}) {
+	ticker := time.NewTicker(dangerousActivationTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			st.expirePending()
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRuntimeStateConfig(t *testing.T) {
+	prev := getConfig()
+	t.Cleanup(func() { setConfig(prev) })
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			setConfig(&BotConfiguration{GuildID: fmt.Sprint(i)})
+		}(i)
+		go func() {
+			defer wg.Done()
+			if c := getConfig(); c != nil {
+				_ = c.GuildID
+			}
+		}()
+	}
+	wg.Wait()
+	if getConfig() == nil {
+		t.Error("config is gone")
+	}
+}
+
+func TestRuntimeStatePending(t *testing.T) {
+	st := &runtimeState{pending: map[string]activationRequest{}}
+	var wg sync.WaitGroup
+	stored := make(chan string, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if _, ok := st.requestPending("channel", activationRequest{when: time.Now(), byUser: user}); ok {
+				stored <- user
+			}
+			st.expirePending()
+		}(fmt.Sprint(i))
+	}
+	wg.Wait()
+	close(stored)
+	winners := []string{}
+	for u := range stored {
+		winners = append(winners, u)
+	}
+	if len(winners) != 1 {
+		t.Fatalf("%d requests were stored for one channel", len(winners))
+	}
+	if _, ok := st.takePending("channel", "someone else"); !ok {
+		t.Fatal("pending request is not there")
+	}
+	if r, ok := st.takePending("channel", winners[0]); !ok || r.byUser != winners[0] {
+		t.Fatalf("request of %s was taken by someone else", winners[0])
+	}
+	if _, ok := st.takePending("channel", winners[0]); ok {
+		t.Error("request was not removed when taken")
+	}
+
+	st.requestPending("channel", activationRequest{when: time.Now().Add(-dangerousActivationTimeout - time.Second)})
+	if _, ok := st.requestPending("channel", activationRequest{when: time.Now(), byUser: "new"}); !ok {
+		t.Error("expired request blocks new one")
+	}
+}
@@ -2,33 +2,197 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
-func commandStatus(s *discordgo.Session, i *discordgo.InteractionCreate) {
-	PRreq, err := http.NewRequest("GET", "https://xnotify.xboxlive.com/servicestatusv6/"+config.StatusQueryRegion1+"/"+config.StatusQueryRegion2, nil)
+const (
+	defaultXboxStatusURL        = "https://xnotify.xboxlive.com/servicestatusv6"
+	defaultMinecraftServicesURL = "https://api.minecraftservices.com"
+	defaultSessionServerURL     = "https://sessionserver.mojang.com"
+	defaultStatusRegion1        = "US"
+	defaultStatusRegion2        = "en-US"
+	statusRequestTimeout        = 2 * time.Second
+	// any existing profile works, this one is Notch
+	statusProbeUUID = "069a79f444e94726a5befca90e38aaf5"
+)
+
+// Service health levels, ordered from best to worst
+const (
+	healthOK = iota
+	healthDegraded
+	healthDown
+)
+
+type serviceStatus struct {
+	Name    string
+	Health  int
+	Detail  string
+	Latency time.Duration
+}
+
+// statusChecker queries service endpoints, base URLs are configurable
+// so it can be pointed at something else than production
+type statusChecker struct {
+	client               *http.Client
+	xboxStatusURL        string
+	minecraftServicesURL string
+	sessionServerURL     string
+	region1, region2     string
+}
+
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return strings.TrimSuffix(v, "/")
+}
+
+func newStatusChecker(conf *BotConfiguration) *statusChecker {
+	return &statusChecker{
+		client:               &http.Client{Timeout: statusRequestTimeout},
+		xboxStatusURL:        orDefault(conf.StatusXboxURL, defaultXboxStatusURL),
+		minecraftServicesURL: orDefault(conf.StatusMinecraftServicesURL, defaultMinecraftServicesURL),
+		sessionServerURL:     orDefault(conf.StatusSessionServerURL, defaultSessionServerURL),
+		region1:              orDefault(conf.StatusQueryRegion1, defaultStatusRegion1),
+		region2:              orDefault(conf.StatusQueryRegion2, defaultStatusRegion2),
+	}
+}
+
+// xblStatus is the part of Xbox Live service status payload we care about
+type xblStatus struct {
+	Overall struct {
+		State       string `json:"State"`
+		LastUpdated string `json:"LastUpdated"`
+	} `json:"Overall"`
+	CoreServices []struct {
+		Name   string `json:"Name"`
+		Status struct {
+			Name string `json:"Name"`
+		} `json:"Status"`
+	} `json:"CoreServices"`
+}
+
+// xblHealth maps Xbox Live status names, "None" means there are no incidents
+func xblHealth(state string) int {
+	switch state {
+	case "None", "":
+		return healthOK
+	case "Major":
+		return healthDown
+	}
+	return healthDegraded
+}
+
+func (c *statusChecker) checkXboxLive() []serviceStatus {
+	started := time.Now()
+	failed := func(err error) []serviceStatus {
+		return []serviceStatus{{"Xbox Live", healthDown, err.Error(), time.Since(started)}}
+	}
+	req, err := http.NewRequest("GET", c.xboxStatusURL+"/"+c.region1+"/"+c.region2, nil)
 	if err != nil {
-		iTextResponse(s, i, "Failed to create request for XBL service status: "+err.Error())
-		return
+		return failed(err)
 	}
-	PRreq.Header.Add("Accept", "application/json")
-	client := &http.Client{
-		Timeout: 1 * time.Second,
+	req.Header.Add("Accept", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return failed(err)
 	}
-	PRresp, err := client.Do(PRreq)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return failed(fmt.Errorf("status page responded with %s", resp.Status))
+	}
+	var status xblStatus
+	err = json.NewDecoder(resp.Body).Decode(&status)
 	if err != nil {
-		iTextResponse(s, i, "XBL service status request failed: "+err.Error())
-		return
+		return failed(fmt.Errorf("malformed status JSON: %w", err))
+	}
+	latency := time.Since(started)
+	ret := []serviceStatus{{"Xbox Live", xblHealth(status.Overall.State), status.Overall.State, latency}}
+	for _, s := range status.CoreServices {
+		ret = append(ret, serviceStatus{"Xbox Live " + s.Name, xblHealth(s.Status.Name), s.Status.Name, latency})
+	}
+	return ret
+}
+
+// checkEndpoint treats any response that is not a server error as
+// service being up, unauthenticated requests are expected to be refused
+func (c *statusChecker) checkEndpoint(name, url string) serviceStatus {
+	started := time.Now()
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return serviceStatus{name, healthDown, err.Error(), time.Since(started)}
 	}
-	var PRres map[string]interface{}
-	err = json.NewDecoder(PRresp.Body).Decode(&PRres)
+	resp.Body.Close()
+	ret := serviceStatus{name, healthOK, resp.Status, time.Since(started)}
+	if resp.StatusCode >= 500 {
+		ret.Health = healthDown
+	} else if resp.StatusCode == http.StatusTooManyRequests {
+		ret.Health = healthDegraded
+	}
+	return ret
+}
+
+// check queries all services at once
+func (c *statusChecker) check() []serviceStatus {
+	var (
+		xbl           []serviceStatus
+		auth, session serviceStatus
+		wg            sync.WaitGroup
+	)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		xbl = c.checkXboxLive()
+	}()
+	go func() {
+		defer wg.Done()
+		auth = c.checkEndpoint("Minecraft auth", c.minecraftServicesURL+"/minecraft/profile")
+	}()
+	go func() {
+		defer wg.Done()
+		session = c.checkEndpoint("Minecraft sessions", c.sessionServerURL+"/session/minecraft/profile/"+statusProbeUUID)
+	}()
+	wg.Wait()
+	return append(xbl, auth, session)
+}
+
+func statusEmbed(statuses []serviceStatus) *discordgo.MessageEmbed {
+	worst := healthOK
+	fields := []*discordgo.MessageEmbedField{}
+	for _, s := range statuses {
+		if s.Health > worst {
+			worst = s.Health
+		}
+		value := [...]string{":green_circle:", ":yellow_circle:", ":red_circle:"}[s.Health]
+		if s.Detail != "" {
+			value += " " + s.Detail
+		}
+		value += fmt.Sprintf(" (%dms)", s.Latency.Milliseconds())
+		fields = append(fields, &discordgo.MessageEmbedField{Name: s.Name, Value: value, Inline: true})
+	}
+	return &discordgo.MessageEmbed{
+		Title:     "Service status",
+		Color:     [...]int{0x2ecc71, 0xf1c40f, 0xe74c3c}[worst],
+		Fields:    fields,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+}
+
+func commandStatus(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
 	if err != nil {
-		iTextResponse(s, i, "XBL service status responded with malformed JSON: "+err.Error())
 		return
 	}
-	// https://xnotify.xboxlive.com/servicestatusv6/CA/en-CA
-	// https://api.mojang.com/users/profiles/minecraft/Jeb
+	statuses := newStatusChecker(getConfig()).check()
+	s.InteractionResponseEdit(s.State.User.ID, i.Interaction, &discordgo.WebhookEdit{
+		Embeds: []*discordgo.MessageEmbed{statusEmbed(statuses)},
+	})
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func stubStatusChecker(t *testing.T, handler http.HandlerFunc) *statusChecker {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return newStatusChecker(&BotConfiguration{
+		StatusXboxURL:              srv.URL,
+		StatusMinecraftServicesURL: srv.URL,
+		StatusSessionServerURL:     srv.URL,
+	})
+}
+
+func TestCheckXboxLive(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   []int
+	}{
+		{"normal", http.StatusOK, `{"Overall":{"State":"Impacted"},"CoreServices":[
+			{"Name":"Sign in","Status":{"Name":"None"}},
+			{"Name":"Social","Status":{"Name":"Major"}}]}`, []int{healthDegraded, healthOK, healthDown}},
+		{"non-200", http.StatusServiceUnavailable, `{}`, []int{healthDown}},
+		{"malformed", http.StatusOK, `{"Overall":`, []int{healthDown}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := stubStatusChecker(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/US/en-US" {
+					t.Errorf("unexpected path %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			got := c.checkXboxLive()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d statuses, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, s := range got {
+				if s.Health != tt.want[i] {
+					t.Errorf("status %d %q health %d, want %d", i, s.Name, s.Health, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckEndpoint(t *testing.T) {
+	tests := []struct {
+		status int
+		want   int
+	}{
+		{http.StatusUnauthorized, healthOK},
+		{http.StatusNoContent, healthOK},
+		{http.StatusTooManyRequests, healthDegraded},
+		{http.StatusInternalServerError, healthDown},
+		{http.StatusBadGateway, healthDown},
+	}
+	for _, tt := range tests {
+		c := stubStatusChecker(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		})
+		got := c.checkEndpoint("test", c.minecraftServicesURL+"/minecraft/profile")
+		if got.Health != tt.want {
+			t.Errorf("status %d: health %d, want %d", tt.status, got.Health, tt.want)
+		}
+	}
+}
+
+func TestStatusEmbedColor(t *testing.T) {
+	tests := []struct {
+		health []int
+		want   int
+	}{
+		{[]int{healthOK, healthOK}, 0x2ecc71},
+		{[]int{healthOK, healthDegraded}, 0xf1c40f},
+		{[]int{healthDegraded, healthDown, healthOK}, 0xe74c3c},
+	}
+	for _, tt := range tests {
+		statuses := []serviceStatus{}
+		for _, h := range tt.health {
+			statuses = append(statuses, serviceStatus{Name: "test", Health: h})
+		}
+		e := statusEmbed(statuses)
+		if e.Color != tt.want {
+			t.Errorf("health %v: color %x, want %x", tt.health, e.Color, tt.want)
+		}
+		if len(e.Fields) != len(statuses) {
+			t.Errorf("health %v: %d fields, want %d", tt.health, len(e.Fields), len(statuses))
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Credential store backends
+const (
+	credentialsStoreDirectory = "directory"
+	credentialsStoreBolt      = "bbolt"
+	credentialsStoreMemory    = "memory"
+)
+
+const defaultCredentialsDatabase = "./credentials.db"
+
+var ErrorCredentialsNotFound = errors.New("credentials not found")
+
+var credentialsNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+type ErrorUnsafeCredentialsName struct {
+	Name string
+}
+
+func (e *ErrorUnsafeCredentialsName) Error() string {
+	return fmt.Sprintf("credentials name `%s` is not allowed, use up to 64 letters, digits, dots, dashes and underscores not starting with a dot", e.Name)
+}
+
+// validateCredentialsName makes sure name can not escape cache directory
+func validateCredentialsName(name string) error {
+	if !credentialsNameRegexp.MatchString(name) || strings.Contains(name, "..") {
+		return &ErrorUnsafeCredentialsName{name}
+	}
+	return nil
+}
+
+// credentialsStore keeps credential cache entries by credentials name,
+// entries are opaque (and possibly encrypted) to the store
+type credentialsStore interface {
+	Load(name string) ([]byte, error)
+	Save(name string, data []byte) error
+	// List returns every credentials name in the store, directory store
+	// can also list files that are not credentials at all
+	List() ([]string, error)
+	Close() error
+}
+
+// openStore is the store with operations that are still using it, it is
+// closed only after all of them are done
+type openStore struct {
+	credentialsStore
+	inUse sync.RWMutex
+}
+
+var (
+	credentials          *openStore
+	credentialsSetup     string
+	credentialsStoreLock sync.Mutex
+)
+
+// directoryStore is a file per credentials name in a directory
+type directoryStore struct {
+	path string
+}
+
+// file returns path of credentials file, it never points outside of directory
+func (d directoryStore) file(name string) (string, error) {
+	if err := validateCredentialsName(name); err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(d.path)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	if filepath.Dir(path) != dir {
+		return "", &ErrorUnsafeCredentialsName{name}
+	}
+	return path, nil
+}
+
+func (d directoryStore) Load(name string) ([]byte, error) {
+	path, err := d.file(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrorCredentialsNotFound, name)
+	}
+	return data, err
+}
+
+func (d directoryStore) Save(name string, data []byte) error {
+	path, err := d.file(name)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func (d directoryStore) List() ([]string, error) {
+	dir := d.path
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := []string{}
+	for _, e := range entries {
+		if e.Type().IsRegular() && validateCredentialsName(e.Name()) == nil {
+			ret = append(ret, e.Name())
+		}
+	}
+	return ret, nil
+}
+
+func (d directoryStore) Close() error {
+	return nil
+}
+
+var credentialsBucket = []byte("credentials")
+
+// boltStore keeps everything in a single bbolt database file
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(credentialsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (b *boltStore) Load(name string) (data []byte, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(credentialsBucket).Get([]byte(name))
+		if v == nil {
+			return fmt.Errorf("%w: %s", ErrorCredentialsNotFound, name)
+		}
+		// value is only valid during transaction
+		data = append([]byte{}, v...)
+		return nil
+	})
+	return
+}
+
+func (b *boltStore) Save(name string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(credentialsBucket).Put([]byte(name), data)
+	})
+}
+
+func (b *boltStore) List() ([]string, error) {
+	ret := []string{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(credentialsBucket).ForEach(func(k, _ []byte) error {
+			ret = append(ret, string(k))
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (b *boltStore) Close() error {
+	return b.db.Close()
+}
+
+// memoryStore is lost on exit, meant for tests
+type memoryStore struct {
+	lock    sync.Mutex
+	entries map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: map[string][]byte{}}
+}
+
+func (m *memoryStore) Load(name string) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	data, ok := m.entries[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrorCredentialsNotFound, name)
+	}
+	return append([]byte{}, data...), nil
+}
+
+func (m *memoryStore) Save(name string, data []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.entries[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memoryStore) List() ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]string, 0, len(m.entries))
+	for name := range m.entries {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+func (c BotConfiguration) credentialsStoreKind() string {
+	if c.CredentialsStore == "" {
+		return credentialsStoreDirectory
+	}
+	return c.CredentialsStore
+}
+
+func (c BotConfiguration) credentialsDatabase() string {
+	if c.CredentialsDatabase == "" {
+		return defaultCredentialsDatabase
+	}
+	return c.CredentialsDatabase
+}
+
+func openCredentialsStore(conf *BotConfiguration) (credentialsStore, error) {
+	switch conf.credentialsStoreKind() {
+	case credentialsStoreDirectory:
+		return directoryStore{path: conf.AccountsCredentialCachePath}, nil
+	case credentialsStoreBolt:
+		return newBoltStore(conf.credentialsDatabase())
+	case credentialsStoreMemory:
+		return newMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown credentials store `%s`", conf.CredentialsStore)
+}
+
+// credentialsStoreSetup is everything store depends on, store is reopened
+// when it changes
+func (c BotConfiguration) credentialsStoreSetup() string {
+	switch kind := c.credentialsStoreKind(); kind {
+	case credentialsStoreDirectory:
+		return kind + ":" + filepath.Clean(c.AccountsCredentialCachePath)
+	case credentialsStoreBolt:
+		return kind + ":" + filepath.Clean(c.credentialsDatabase())
+	default:
+		return kind
+	}
+}
+
+// preparedStore is store opened for config that is not applied yet, it
+// is nil when config uses the store that is already open
+type preparedStore struct {
+	store credentialsStore
+	setup string
+}
+
+// prepareCredentialsStore opens store described by config without
+// touching the current one, store is reopened only if its settings changed
+func prepareCredentialsStore(conf *BotConfiguration) (*preparedStore, error) {
+	setup := conf.credentialsStoreSetup()
+	credentialsStoreLock.Lock()
+	same := credentials != nil && setup == credentialsSetup
+	credentialsStoreLock.Unlock()
+	if same {
+		return nil, nil
+	}
+	store, err := openCredentialsStore(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedStore{store: store, setup: setup}, nil
+}
+
+// use makes prepared store current, previous store is closed after
+// operations that still use it are done
+func (p *preparedStore) use() {
+	if p == nil {
+		return
+	}
+	credentialsStoreLock.Lock()
+	prev := credentials
+	credentials = &openStore{credentialsStore: p.store}
+	credentialsSetup = p.setup
+	credentialsStoreLock.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+}
+
+// discard closes prepared store that is not going to be used
+func (p *preparedStore) discard() {
+	if p == nil {
+		return
+	}
+	if err := p.store.Close(); err != nil {
+		log.Printf("Failed to close credentials store: %v", err)
+	}
+}
+
+// setupCredentialsStore opens store described by config and makes it
+// current, the current one stays in use if that fails. Config changes
+// are serialized by configEdit so setups do not overlap.
+func setupCredentialsStore(conf *BotConfiguration) error {
+	p, err := prepareCredentialsStore(conf)
+	if err != nil {
+		return err
+	}
+	p.use()
+	return nil
+}
+
+func (o *openStore) close() {
+	o.inUse.Lock()
+	defer o.inUse.Unlock()
+	if err := o.Close(); err != nil {
+		log.Printf("Failed to close credentials store: %v", err)
+	}
+}
+
+// useCredentialsStore runs f with store that is in use, store is not
+// closed until f returns even if it is replaced meanwhile
+func useCredentialsStore(f func(store credentialsStore) error) error {
+	credentialsStoreLock.Lock()
+	store := credentials
+	if store != nil {
+		store.inUse.RLock()
+	}
+	credentialsStoreLock.Unlock()
+	if store == nil {
+		return errors.New("credentials store is not open")
+	}
+	defer store.inUse.RUnlock()
+	return f(store.credentialsStore)
+}
+
+func closeCredentialsStore() {
+	credentialsStoreLock.Lock()
+	prev := credentials
+	credentials = nil
+	credentialsStoreLock.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var credentialsNameTests = []struct {
+	name string
+	ok   bool
+}{
+	{"account", true},
+	{"main.json", true},
+	{"alt_account-2", true},
+	{strings.Repeat("a", 64), true},
+	{strings.Repeat("a", 65), false},
+	{"", false},
+	{".", false},
+	{"..", false},
+	{"../x", false},
+	{"a/../../b", false},
+	{"a/b", false},
+	{"a..b", false},
+	{".hidden", false},
+	{"/etc/passwd", false},
+	{`C:\creds`, false},
+	{`..\x`, false},
+	{`a\b`, false},
+}
+
+func TestValidateCredentialsName(t *testing.T) {
+	for _, tt := range credentialsNameTests {
+		err := validateCredentialsName(tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("%q: %v", tt.name, err)
+		}
+		var unsafe *ErrorUnsafeCredentialsName
+		if !tt.ok && !errors.As(err, &unsafe) {
+			t.Errorf("%q: got %v, want ErrorUnsafeCredentialsName", tt.name, err)
+		}
+	}
+}
+
+func TestDirectoryStoreFile(t *testing.T) {
+	dir := t.TempDir()
+	d := directoryStore{path: dir}
+	for _, tt := range credentialsNameTests {
+		path, err := d.file(tt.name)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%q: got path %s", tt.name, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.name, err)
+		} else if path != filepath.Join(dir, tt.name) {
+			t.Errorf("%q: got path %s outside of %s", tt.name, path, dir)
+		}
+	}
+}
+
+func TestSetupCredentialsStoreSwap(t *testing.T) {
+	dir := t.TempDir()
+	bolt := &BotConfiguration{CredentialsStore: credentialsStoreBolt, CredentialsDatabase: filepath.Join(dir, "credentials.db")}
+	if err := setupCredentialsStore(bolt); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeCredentialsStore)
+	err := useCredentialsStore(func(store credentialsStore) error {
+		return store.Save("acc", []byte("data"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	using := make(chan struct{})
+	release := make(chan struct{})
+	used := make(chan error)
+	go func() {
+		used <- useCredentialsStore(func(store credentialsStore) error {
+			close(using)
+			<-release
+			_, err := store.Load("acc")
+			return err
+		})
+	}()
+	<-using
+
+	setupDone := make(chan error)
+	go func() {
+		setupDone <- setupCredentialsStore(&BotConfiguration{CredentialsStore: credentialsStoreMemory})
+	}()
+	// new store is in use right away, old one waits for its users
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var kind credentialsStore
+		useCredentialsStore(func(store credentialsStore) error {
+			kind = store
+			return nil
+		})
+		if _, ok := kind.(*memoryStore); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("memory store was not swapped in")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-setupDone:
+		t.Fatalf("setup closed store that is still in use: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-used; err != nil {
+		t.Errorf("store got closed under its user: %v", err)
+	}
+	if err := <-setupDone; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetupCredentialsStoreFailureKeepsCurrent(t *testing.T) {
+	if err := setupCredentialsStore(&BotConfiguration{CredentialsStore: credentialsStoreMemory}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(closeCredentialsStore)
+	err := setupCredentialsStore(&BotConfiguration{CredentialsStore: credentialsStoreBolt, CredentialsDatabase: filepath.Join(t.TempDir(), "missing", "credentials.db")})
+	if err == nil {
+		t.Fatal("bbolt database in missing directory was opened")
+	}
+	err = useCredentialsStore(func(store credentialsStore) error {
+		return store.Save("acc", []byte("data"))
+	})
+	if err != nil {
+		t.Errorf("current store is gone after failed setup: %v", err)
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/Tnze/go-mc/bot"
+	"github.com/Tnze/go-mc/data/block"
+	"github.com/Tnze/go-mc/data/entity"
+	"github.com/Tnze/go-mc/data/packetid"
+	"github.com/Tnze/go-mc/nbt"
+	pk "github.com/Tnze/go-mc/net/packet"
+)
+
+// blockUnknown is state of a block that server did not tell us about yet
+const blockUnknown = -1
+
+// blockTracker remembers states of watched blocks from block updates
+// and chunk data the server sends, so activation can be verified.
+type blockTracker struct {
+	lock   sync.Mutex
+	states map[pk.Position]int
+	// changes counts state changes that were not loads of unknown state
+	changes map[pk.Position]int
+	minY    int
+	height  int
+	updated chan struct{}
+}
+
+func newBlockTracker(positions ...pk.Position) *blockTracker {
+	t := &blockTracker{
+		states:  map[pk.Position]int{},
+		changes: map[pk.Position]int{},
+		height:  256,
+		updated: make(chan struct{}),
+	}
+	for _, p := range positions {
+		t.states[p] = blockUnknown
+	}
+	return t
+}
+
+func chamberBlockPos(c Chamber) pk.Position {
+	return pk.Position{X: int(math.Floor(c.Pos[0])), Y: int(math.Floor(c.Pos[1])), Z: int(math.Floor(c.Pos[2]))}
+}
+
+func newRoomBlockTracker(room PearlRoom) *blockTracker {
+	positions := []pk.Position{}
+	for _, c := range room.Chambers {
+		positions = append(positions, chamberBlockPos(c))
+	}
+	return newBlockTracker(positions...)
+}
+
+// Watch starts tracking positions that are not tracked yet, their state
+// is unknown until server sends an update
+func (t *blockTracker) Watch(positions ...pk.Position) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, p := range positions {
+		if _, ok := t.states[p]; !ok {
+			t.states[p] = blockUnknown
+		}
+	}
+}
+
+func (t *blockTracker) Attach(c *bot.Client) {
+	c.Events.AddListener(
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundLogin, F: t.onJoinGame},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundRespawn, F: t.onRespawn},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundBlockUpdate, F: t.onBlockUpdate},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundSectionBlocksUpdate, F: t.onSectionBlocksUpdate},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundLevelChunkWithLight, F: t.onLevelChunk},
+	)
+}
+
+// State returns last known state of the block at pos
+func (t *blockTracker) State(pos pk.Position) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s, ok := t.states[pos]; ok {
+		return s
+	}
+	return blockUnknown
+}
+
+// Changes tells how many times block at pos changed from one known
+// state to another, toggled block changes even if it toggles back
+func (t *blockTracker) Changes(pos pk.Position) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.changes[pos]
+}
+
+// WaitChange waits until block at pos gets state other than from
+// and returns the state it has after that or when timeout passes
+func (t *blockTracker) WaitChange(pos pk.Position, from int, timeout time.Duration) (int, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		t.lock.Lock()
+		state, ok := t.states[pos]
+		updated := t.updated
+		t.lock.Unlock()
+		if ok && state != blockUnknown && state != from {
+			return state, true
+		}
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return state, false
+		}
+	}
+}
+
+func (t *blockTracker) set(pos pk.Position, state int) {
+	if _, ok := t.states[pos]; !ok {
+		return
+	}
+	if prev := t.states[pos]; prev != blockUnknown && state != blockUnknown && prev != state {
+		t.changes[pos]++
+	}
+	t.states[pos] = state
+	close(t.updated)
+	t.updated = make(chan struct{})
+}
+
+type dimensionType struct {
+	MinY   int32 `nbt:"min_y"`
+	Height int32 `nbt:"height"`
+}
+
+func (t *blockTracker) setDimension(dim dimensionType) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.minY = int(dim.MinY)
+	t.height = int(dim.Height)
+	for p := range t.states {
+		t.set(p, blockUnknown)
+	}
+}
+
+func (t *blockTracker) onJoinGame(p pk.Packet) error {
+	var (
+		eid          pk.Int
+		hardcore     pk.Boolean
+		gamemode     pk.UnsignedByte
+		prevGamemode pk.Byte
+		worldNames   []pk.Identifier
+		dim          dimensionType
+	)
+	err := p.Scan(&eid, &hardcore, &gamemode, &prevGamemode, pk.Array(&worldNames),
+		pk.NBT(new(nbt.RawMessage)), pk.NBT(&dim))
+	if err != nil {
+		return err
+	}
+	t.setDimension(dim)
+	return nil
+}
+
+func (t *blockTracker) onRespawn(p pk.Packet) error {
+	var dim dimensionType
+	if err := p.Scan(pk.NBT(&dim)); err != nil {
+		return err
+	}
+	t.setDimension(dim)
+	return nil
+}
+
+func (t *blockTracker) onBlockUpdate(p pk.Packet) error {
+	var (
+		pos   pk.Position
+		state pk.VarInt
+	)
+	if err := p.Scan(&pos, &state); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.set(pos, int(state))
+	return nil
+}
+
+func (t *blockTracker) onSectionBlocksUpdate(p pk.Packet) error {
+	var (
+		sectionPos pk.Long
+		trustEdges pk.Boolean
+		blocks     []pk.VarLong
+	)
+	if err := p.Scan(&sectionPos, &trustEdges, pk.Array(&blocks)); err != nil {
+		return err
+	}
+	sx := int(sectionPos >> 42)
+	sy := int(sectionPos << 44 >> 44)
+	sz := int(sectionPos << 22 >> 42)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, b := range blocks {
+		pos := pk.Position{
+			X: sx*16 + int(b>>8&0xF),
+			Y: sy*16 + int(b&0xF),
+			Z: sz*16 + int(b>>4&0xF),
+		}
+		t.set(pos, int(b>>12))
+	}
+	return nil
+}
+
+func (t *blockTracker) onLevelChunk(p pk.Packet) error {
+	var (
+		cx, cz pk.Int
+		data   pk.ByteArray
+	)
+	if err := p.Scan(&cx, &cz, pk.NBT(new(nbt.RawMessage)), &data); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	watched := map[int][]pk.Position{}
+	for pos := range t.states {
+		if floorDiv(pos.X, 16) == int(cx) && floorDiv(pos.Z, 16) == int(cz) {
+			s := floorDiv(pos.Y-t.minY, 16)
+			watched[s] = append(watched[s], pos)
+		}
+	}
+	if len(watched) == 0 {
+		return nil
+	}
+	r := bytes.NewReader(data)
+	for s := 0; s < t.height/16; s++ {
+		var section chunkSection
+		if err := section.read(r); err != nil {
+			return fmt.Errorf("chunk %d %d section %d: %w", cx, cz, s, err)
+		}
+		for _, pos := range watched[s] {
+			i := (pos.Y-t.minY)&0xF<<8 | (pos.Z&0xF)<<4 | pos.X&0xF
+			t.set(pos, section.states.get(i))
+		}
+	}
+	return nil
+}
+
+func floorDiv(a, b int) int {
+	if a < 0 && a%b != 0 {
+		return a/b - 1
+	}
+	return a / b
+}
+
+// chunkSection is a network representation of 16x16x16 blocks,
+// biomes are read only to skip them
+type chunkSection struct {
+	states paletted
+	biomes paletted
+}
+
+func (s *chunkSection) read(r io.Reader) error {
+	var blockCount pk.Short
+	if _, err := blockCount.ReadFrom(r); err != nil {
+		return err
+	}
+	if err := s.states.read(r, 4, 8); err != nil {
+		return err
+	}
+	return s.biomes.read(r, 1, 3)
+}
+
+// paletted is a paletted container, values are either indexes in the
+// palette or global ids when there is no palette
+type paletted struct {
+	bits    int
+	single  int
+	palette []int
+	data    []uint64
+}
+
+func (c *paletted) read(r io.Reader, minBits, maxLinearBits int) error {
+	var bits pk.UnsignedByte
+	if _, err := bits.ReadFrom(r); err != nil {
+		return err
+	}
+	c.bits = int(bits)
+	if c.bits == 0 {
+		var v pk.VarInt
+		if _, err := v.ReadFrom(r); err != nil {
+			return err
+		}
+		c.single = int(v)
+	} else if c.bits <= maxLinearBits {
+		if c.bits < minBits {
+			c.bits = minBits
+		}
+		var values []pk.VarInt
+		if _, err := pk.Array(&values).ReadFrom(r); err != nil {
+			return err
+		}
+		c.palette = make([]int, len(values))
+		for i, v := range values {
+			c.palette[i] = int(v)
+		}
+	}
+	var longs []pk.Long
+	if _, err := pk.Array(&longs).ReadFrom(r); err != nil {
+		return err
+	}
+	c.data = make([]uint64, len(longs))
+	for i, l := range longs {
+		c.data[i] = uint64(l)
+	}
+	return nil
+}
+
+func (c *paletted) get(i int) int {
+	if c.bits == 0 {
+		return c.single
+	}
+	perLong := 64 / c.bits
+	if i/perLong >= len(c.data) {
+		return blockUnknown
+	}
+	v := int(c.data[i/perLong] >> uint(i%perLong*c.bits) & (1<<uint(c.bits) - 1))
+	if c.palette == nil {
+		return v
+	}
+	if v >= len(c.palette) {
+		return blockUnknown
+	}
+	return c.palette[v]
+}
+
+// blockStateString describes block state for humans
+func blockStateString(state int) string {
+	if state == blockUnknown {
+		return "unknown (chunk not loaded)"
+	}
+	id, ok := block.StateID[uint32(state)]
+	if !ok {
+		return fmt.Sprintf("state %d", state)
+	}
+	return fmt.Sprintf("%s (state %d)", block.ByID[id].Name, state)
+}
+
+// A pearl is considered to be sitting in a chamber if it is within
+// pearlSearchRadius of the chamber block center horizontally and within
+// pearlSearchHeight vertically. Chambers are often next to each other so
+// horizontal radius is smaller than distance between neighbours, vertically
+// pearl can be a couple of blocks away from the block bot clicks.
+const (
+	pearlSearchRadius = 0.6
+	pearlSearchHeight = 2.5
+)
+
+// pearlTracker follows thrown ender pearl entities around the bot
+type pearlTracker struct {
+	lock    sync.Mutex
+	pearls  map[int32][3]float64
+	updated chan struct{}
+}
+
+func newPearlTracker() *pearlTracker {
+	return &pearlTracker{
+		pearls:  map[int32][3]float64{},
+		updated: make(chan struct{}),
+	}
+}
+
+func (t *pearlTracker) Attach(c *bot.Client) {
+	c.Events.AddListener(
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundRespawn, F: t.onRespawn},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundAddEntity, F: t.onAddEntity},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundMoveEntityPos, F: t.onMoveEntity},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundMoveEntityPosRot, F: t.onMoveEntity},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundTeleportEntity, F: t.onTeleportEntity},
+		bot.PacketHandler{Priority: 64, ID: packetid.ClientboundRemoveEntities, F: t.onRemoveEntities},
+	)
+}
+
+// Near counts pearls sitting in the chamber with block at pos
+func (t *pearlTracker) Near(pos pk.Position) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.near(pos)
+}
+
+func (t *pearlTracker) near(pos pk.Position) int {
+	count := 0
+	for _, p := range t.pearls {
+		dx := p[0] - (float64(pos.X) + 0.5)
+		dy := p[1] - (float64(pos.Y) + 0.5)
+		dz := p[2] - (float64(pos.Z) + 0.5)
+		if dx*dx+dz*dz <= pearlSearchRadius*pearlSearchRadius && math.Abs(dy) <= pearlSearchHeight {
+			count++
+		}
+	}
+	return count
+}
+
+// WaitGone waits until there are no pearls near pos
+func (t *pearlTracker) WaitGone(pos pk.Position, timeout time.Duration) bool {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		t.lock.Lock()
+		count := t.near(pos)
+		updated := t.updated
+		t.lock.Unlock()
+		if count == 0 {
+			return true
+		}
+		select {
+		case <-updated:
+		case <-deadline.C:
+			return false
+		}
+	}
+}
+
+func (t *pearlTracker) notify() {
+	close(t.updated)
+	t.updated = make(chan struct{})
+}
+
+func (t *pearlTracker) onRespawn(_ pk.Packet) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pearls = map[int32][3]float64{}
+	t.notify()
+	return nil
+}
+
+func (t *pearlTracker) onAddEntity(p pk.Packet) error {
+	var (
+		eid        pk.VarInt
+		uuid       pk.UUID
+		entityType pk.VarInt
+		x, y, z    pk.Double
+	)
+	if err := p.Scan(&eid, &uuid, &entityType, &x, &y, &z); err != nil {
+		return err
+	}
+	if entity.ID(entityType) != entity.EnderPearl.ID {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pearls[int32(eid)] = [3]float64{float64(x), float64(y), float64(z)}
+	t.notify()
+	return nil
+}
+
+func (t *pearlTracker) onMoveEntity(p pk.Packet) error {
+	var (
+		eid        pk.VarInt
+		dx, dy, dz pk.Short
+	)
+	if err := p.Scan(&eid, &dx, &dy, &dz); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	pos, ok := t.pearls[int32(eid)]
+	if !ok {
+		return nil
+	}
+	pos[0] += float64(dx) / 4096
+	pos[1] += float64(dy) / 4096
+	pos[2] += float64(dz) / 4096
+	t.pearls[int32(eid)] = pos
+	t.notify()
+	return nil
+}
+
+func (t *pearlTracker) onTeleportEntity(p pk.Packet) error {
+	var (
+		eid     pk.VarInt
+		x, y, z pk.Double
+	)
+	if err := p.Scan(&eid, &x, &y, &z); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.pearls[int32(eid)]; !ok {
+		return nil
+	}
+	t.pearls[int32(eid)] = [3]float64{float64(x), float64(y), float64(z)}
+	t.notify()
+	return nil
+}
+
+func (t *pearlTracker) onRemoveEntities(p pk.Packet) error {
+	var eids []pk.VarInt
+	if err := p.Scan(pk.Array(&eids)); err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, eid := range eids {
+		delete(t.pearls, int32(eid))
+	}
+	t.notify()
+	return nil
+}